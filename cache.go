@@ -6,25 +6,118 @@ import (
 )
 
 var (
-	ErrNotPresent = errors.New("cache: Value not present")
+	ErrNotPresent     = errors.New("cache: Value not present")
+	ErrNotFound       = errors.New("cache: Value not found")
+	ErrNoLoader       = errors.New("cache: No value loader configured")
+	ErrNoExpiry       = errors.New("cache: No expiry policy configured")
+	ErrExpiresInPast  = errors.New("cache: Expiry time is in the past")
+	ErrWeightTooLarge = errors.New("cache: Weight exceeds the max weight")
+	ErrLoadTimeout    = errors.New("cache: Value loader timed out")
+	ErrLoaderFailed   = errors.New("cache: Value loader failed")
+	ErrInvalidOption  = errors.New("cache: Invalid option value")
+	ErrOptionConflict = errors.New("cache: Options conflict with each other")
 )
 
+// LoaderError is what a load that failed returns, wrapping whatever the
+// loader returned. errors.Is matches it against ErrLoaderFailed as well as the
+// loader's own error, so a loader's ErrNotFound can be told apart from a plain
+// ErrNotPresent miss. Failures remembered for NegativeTTL or ErrorTTL come
+// back wrapped the same way. A load that times out returns ErrLoadTimeout
+// instead.
+type LoaderError struct {
+	Key string
+	Err error
+}
+
+func (e *LoaderError) Error() string {
+	return ErrLoaderFailed.Error() + " for " + e.Key + ": " + e.Err.Error()
+}
+
+func (e *LoaderError) Unwrap() error {
+	return e.Err
+}
+
+func (e *LoaderError) Is(target error) bool {
+	return target == ErrLoaderFailed
+}
+
+// NoExpiration is the TTL reported for entries in a cache without expiry
+const NoExpiration time.Duration = -1
+
+type RemovalCause int
+
+const (
+	//The entry was removed by Invalidate
+	Explicit RemovalCause = iota
+	//The entry's value was replaced by a Put
+	Replaced
+	//The entry passed its deadline
+	Expired
+	//The entry was evicted to keep the cache within its limits
+	Size
+)
+
+// RemovalListener is told about every entry that leaves a cache. It's only
+// called once the cache has released its lock, so a listener may safely call
+// back into the cache, even to invalidate or put other keys. OnLoad runs
+// without the lock too. Weighers, Sizers, Comparers and the other hooks that
+// decide how an entry is stored run with it held and must not.
+type RemovalListener func(key string, value interface{}, cause RemovalCause)
+
+type removal struct {
+	key   string
+	value interface{}
+	cause RemovalCause
+}
+
+// failedLoad is a loader error remembered for ErrorTTL
+type failedLoad struct {
+	err   error
+	until time.Time
+}
+
 type ValueLoader func(key string) (interface{}, error)
+type LoadHook func(key string, dur time.Duration, err error)
 type Weigher func(key string, value interface{}) int64
+
+// CloneFunc copies a value, with one set the cache stores a copy of whatever is
+// put and hands out a fresh copy on every read
+type CloneFunc func(value interface{}) interface{}
+
+// Encoder turns a value into the form it's stored in, such as compressed
+// bytes, and Decoder turns it back on every read. A power cache with both
+// weighs and sizes values as they're stored.
+type Encoder func(value interface{}) interface{}
+type Decoder func(encoded interface{}) interface{}
+
+// Sizer measures how many bytes a value takes up, it is what MaxSize is
+// enforced with while a Weigher only decides eviction order
+type Sizer func(key string, value interface{}) int64
+
+// Comparer decides eviction order between two entries, returning less than
+// zero if a should be evicted before b, more than zero if b should go first
+// and zero if it doesn't matter. Age is how long ago the entry was last
+// accessed, or in expiring caches how long it has left as a negative, so a
+// bigger age always means closer to eviction.
 type Comparer func(weighta, weightb int64, agea, ageb time.Duration) int64
 
+// KeyNormalizer maps every key given to a power cache onto the key it is
+// stored under, such as strings.ToLower for case insensitive keys. It must
+// give the same key back when given a key it has already normalized.
+type KeyNormalizer func(key string) string
+
 type Cache interface {
 	GetWithValueLoader(key string, valueLoader ValueLoader) (interface{}, error)
 	GetIfPresent(key string) (interface{}, error)
 	//GetAllPresent(keys []string) map[string]interface{}
 	Put(key string, value interface{})
-	//PutAll(map[string]interface{})
+	PutAll(values map[string]interface{})
 	Invalidate(key string)
 	//InvalidateKeys(keys []string)
 	InvalidateAll()
 	//AsMap() map[string]interface{}
 	CleanUp()
-	//Size() int64
+	Size() int64
 	//Stats()
 }
 
@@ -33,24 +126,70 @@ type LoadingCache interface {
 	Get(key string) (interface{}, error)
 	//GetAll(keys []string) map[string]interface{}
 	Refresh(key string)
+	RefreshAll(keys []string, concurrency int) map[string]error
 	Load(key string) (interface{}, error)
 	//LoadAll(keys []string) error
 	//Reload(key string, oldValue interface{}) error
 }
 
+// TTLValue is a value along with how long it has left before it expires
+type TTLValue struct {
+	Value interface{}
+	TTL   time.Duration
+}
+
 type ExpiringCache interface {
-	SetExpiresAt(key string, expires time.Time)
-	SetExpiresIn(key string, expiresIn time.Duration)
+	SetExpiresAt(key string, expires time.Time) error
+	SetExpiresIn(key string, expiresIn time.Duration) error
+	PutWithTTL(key string, value interface{}, ttl time.Duration) error
+	GetWithTTL(key string) (interface{}, time.Duration, error)
+	GetAllWithTTL(keys []string) map[string]TTLValue
+	ExpiresAt(key string) (time.Time, bool)
 }
 
 type PriorityCache interface {
-	SetWeight(key string, weight int64)
+	SetWeight(key string, weight int64) error
+	WeightOf(key string) (int64, bool)
+	WeightedSize() int64
+}
+
+// Stats is a snapshot of the counters. Evictions is the total, broken down by
+// cause into the Explicit, Expired and Size counts. Replaced values aren't
+// evictions so they aren't counted.
+type Stats struct {
+	Hits               int64
+	Misses             int64
+	Requests           int64
+	HitRate            float64
+	Evictions          int64
+	ExplicitEvictions  int64
+	ExpiredEvictions   int64
+	SizeEvictions      int64
+	LoadSuccesses      int64
+	LoadFailures       int64
+	AverageLoadPenalty time.Duration
+}
+
+// KeyStat is how often a single key was requested and found
+type KeyStat struct {
+	Key    string
+	Hits   int64
+	Misses int64
 }
 
 type StatsCache interface {
+	Stats() Stats
+	ResetStats()
 	HitRate() float64
+	MissRate() float64
+	HitCount() int64
+	MissCount() int64
+	RequestCount() int64
 	AverageLoadPenalty() time.Duration
 	EvictionCount() int64
+	LoadCount() int64
+	LoadSuccessCount() int64
+	LoadFailureCount() int64
 }
 
 func NewExpiresAfterAccessCache(accessDuration time.Duration) Cache {
@@ -69,6 +208,18 @@ func NewExpiresAfterWriteCache(writeDuration time.Duration) Cache {
 	return c
 }
 
+// NewExpiringCache creates a cache where a key expires once it has gone
+// unaccessed for accessDuration or was written longer than writeDuration ago,
+// whichever comes first.
+func NewExpiringCache(accessDuration, writeDuration time.Duration) Cache {
+	c := new(PowerCache)
+	c.ExpiresAfterAccessDuration = accessDuration
+	c.ExpiresAfterWriteDuration = writeDuration
+	c.PeriodicMaintenance = time.Minute * 5
+	c.Initialize()
+	return c
+}
+
 func NewMaxKeysCache(maxKeys int) Cache {
 	c := new(PowerCache)
 	c.MaxKeys = maxKeys
@@ -76,6 +227,31 @@ func NewMaxKeysCache(maxKeys int) Cache {
 	return c
 }
 
+// NewSampledCache creates a max keys cache that picks eviction victims from
+// sampleSize random keys rather than keeping every key ordered, trading some
+// accuracy for cheaper reads and writes.
+func NewSampledCache(maxKeys, sampleSize int) Cache {
+	c := new(PowerCache)
+	c.MaxKeys = maxKeys
+	c.EvictionSampleSize = sampleSize
+	if c.EvictionSampleSize == 0 {
+		c.EvictionSampleSize = 5
+	}
+	c.Initialize()
+	return c
+}
+
+// NewTinyLFUCache creates a max keys cache that only lets a new key in when
+// it has been used more often lately than the entry it would evict, so a burst
+// of one off keys can't flush out the popular ones.
+func NewTinyLFUCache(maxKeys int) Cache {
+	c := new(PowerCache)
+	c.MaxKeys = maxKeys
+	c.AdmissionFilter = true
+	c.Initialize()
+	return c
+}
+
 func NewPowerCache() *PowerCache {
 	c := new(PowerCache)
 	c.Initialize()
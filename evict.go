@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"math"
+	"time"
+)
+
+// evictionHeap keeps the keys of a PowerCache ordered so the next eviction
+// victim is always at the top. Keys are fixed in place whenever their weight
+// or timestamps change, so picking a victim no longer needs a full scan. All
+// methods expect the cache lock to be held.
+//
+// A heap can only stay ordered if comparing two keys gives the same answer
+// later on, so rather than scoring ages against the current time each key is
+// given a priority when it is tracked: the floor plus its weight, see
+// priorityOf for how WeightFactor and AgeFactor change that. The floor
+// rises to the priority of every victim, so a key that isn't touched is
+// eventually overtaken by newer keys no matter how heavy, while heavy keys
+// outlast lighter ones used around the same time.
+type evictionHeap struct {
+	c        *PowerCache
+	keys     []string
+	index    map[string]int
+	priority map[string]float64
+	floor    float64
+	now      time.Time
+}
+
+func (h *evictionHeap) Len() int {
+	return len(h.keys)
+}
+
+func (h *evictionHeap) Less(i, j int) bool {
+	return h.c.evictsBefore(h.keys[i], h.keys[j], h.now)
+}
+
+func (h *evictionHeap) Swap(i, j int) {
+	h.keys[i], h.keys[j] = h.keys[j], h.keys[i]
+	h.index[h.keys[i]] = i
+	h.index[h.keys[j]] = j
+}
+
+func (h *evictionHeap) Push(x interface{}) {
+	key := x.(string)
+	h.index[key] = len(h.keys)
+	h.keys = append(h.keys, key)
+}
+
+func (h *evictionHeap) Pop() interface{} {
+	key := h.keys[len(h.keys)-1]
+	h.keys = h.keys[:len(h.keys)-1]
+	delete(h.index, key)
+	return key
+}
+
+// track adds the key or moves it into place after it has changed. Sampled
+// caches don't need the heap so they skip the upkeep, and pinned keys are
+// kept out of it so they can never be picked.
+func (h *evictionHeap) track(key string) {
+	//Anything weighing nothing is prioritized like a 1
+	w := h.c.weight[key]
+	if w <= 0 {
+		w = 1
+	}
+	h.priority[key] = h.priorityOf(float64(w))
+	if h.c.EvictionSampleSize > 0 || h.c.pinned[key] {
+		return
+	}
+	h.now = time.Now()
+	if i, ok := h.index[key]; ok {
+		heap.Fix(h, i)
+		return
+	}
+	heap.Push(h, key)
+}
+
+// priorityOf weighs the weight against the floor, which stands in for age,
+// by WeightFactor to AgeFactor. Left unset they count equally, with no
+// AgeFactor only the weight matters and with no WeightFactor keys go purely
+// by how recently they were used. Negative factors count as 0.
+func (h *evictionHeap) priorityOf(w float64) float64 {
+	wf, af := math.Max(h.c.WeightFactor, 0), math.Max(h.c.AgeFactor, 0)
+	switch {
+	case wf == 0 && af == 0:
+		return h.floor + w
+	case af == 0:
+		return w
+	}
+	return h.floor + w*wf/af
+}
+
+func (h *evictionHeap) untrack(key string) {
+	delete(h.priority, key)
+	if i, ok := h.index[key]; ok {
+		h.now = time.Now()
+		heap.Remove(h, i)
+	}
+}
+
+// raiseFloor is called with each victim before it is evicted
+func (h *evictionHeap) raiseFloor(victim string) {
+	if p := h.priority[victim]; p > h.floor {
+		h.floor = p
+	}
+}
+
+// keyHash is a stable hash of the key, the same in every process, that
+// evictsBefore falls back on to order tied keys. Keys that only differ in
+// their last byte come out of fnv close together, so the sum is put through a
+// murmur3 style finalizer to scatter them.
+func keyHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
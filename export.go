@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+type exportedEntry struct {
+	Key    string          `json:"key"`
+	TTL    string          `json:"ttl,omitempty"`
+	Weight int64           `json:"weight"`
+	Value  json.RawMessage `json:"value,omitempty"`
+}
+
+// ExportJSON writes a JSON array describing every unexpired entry, sorted by
+// key, for use in debugging endpoints. Values are only included if
+// includeValues is set, and any value that can't be marshalled is replaced by
+// a placeholder string rather than failing the whole dump.
+func (c *PowerCache) ExportJSON(w io.Writer, includeValues bool) error {
+	c.mu.RLock()
+	now := time.Now()
+	entries := make([]exportedEntry, 0, len(c.values))
+	for k := range c.values {
+		e := exportedEntry{Key: k, Weight: c.weight[k]}
+		if d, ok := c.deadlineOf(k); ok {
+			if d.Before(now) {
+				continue
+			}
+			e.TTL = d.Sub(now).String()
+		}
+		if includeValues {
+			v := c.valueOf(k)
+			b, err := json.Marshal(v)
+			if err != nil {
+				b, _ = json.Marshal(fmt.Sprintf("<unserializable %T>", v))
+			}
+			e.Value = b
+		}
+		entries = append(entries, e)
+	}
+	c.mu.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,14 @@
+package cache
+
+import (
+	"expvar"
+)
+
+// PublishExpvar registers the cache Stats with the expvar package under name.
+// The stats are read fresh every time expvar serializes them. Like
+// expvar.Publish this panics if name is already registered.
+func (c *PowerCache) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return c.Stats()
+	}))
+}
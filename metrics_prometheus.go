@@ -0,0 +1,64 @@
+//go:build prometheus
+
+package cache
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsCollector exposes the stats of a PowerCache as a prometheus.Collector.
+// It is only built with the prometheus build tag so that the core package stays
+// free of dependencies.
+type MetricsCollector struct {
+	cache        *PowerCache
+	hits         *prometheus.Desc
+	misses       *prometheus.Desc
+	evictions    *prometheus.Desc
+	length       *prometheus.Desc
+	loadDuration prometheus.Histogram
+}
+
+// NewMetricsCollector creates a collector for c with metric names prefixed by
+// name. Load durations are observed through the OnLoad hook, so every load is
+// seen whichever loader ran it, and an OnLoad already set on c still gets
+// called. Create the collector before c starts serving requests.
+func NewMetricsCollector(c *PowerCache, name string) *MetricsCollector {
+	m := &MetricsCollector{
+		cache:     c,
+		hits:      prometheus.NewDesc(name+"_hits_total", "Number of cache hits.", nil, nil),
+		misses:    prometheus.NewDesc(name+"_misses_total", "Number of cache misses.", nil, nil),
+		evictions: prometheus.NewDesc(name+"_evictions_total", "Number of entries evicted.", nil, nil),
+		length:    prometheus.NewDesc(name+"_length", "Number of entries in the cache.", nil, nil),
+		loadDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    name + "_load_duration_seconds",
+			Help:    "Time spent loading values.",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+	next := c.OnLoad
+	c.OnLoad = func(key string, dur time.Duration, err error) {
+		m.loadDuration.Observe(dur.Seconds())
+		if next != nil {
+			next(key, dur, err)
+		}
+	}
+	return m
+}
+
+func (m *MetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.hits
+	ch <- m.misses
+	ch <- m.evictions
+	ch <- m.length
+	m.loadDuration.Describe(ch)
+}
+
+func (m *MetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(m.hits, prometheus.CounterValue, float64(m.cache.HitCount()))
+	ch <- prometheus.MustNewConstMetric(m.misses, prometheus.CounterValue, float64(m.cache.MissCount()))
+	ch <- prometheus.MustNewConstMetric(m.evictions, prometheus.CounterValue, float64(m.cache.EvictionCount()))
+	ch <- prometheus.MustNewConstMetric(m.length, prometheus.GaugeValue, float64(m.cache.Length()))
+	m.loadDuration.Collect(ch)
+}
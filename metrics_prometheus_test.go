@@ -0,0 +1,71 @@
+//go:build prometheus
+
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetricsCollector(t *testing.T) {
+	c := NewPowerCache()
+	c.ValueLoader = fetchFunc
+	hooked := 0
+	c.OnLoad = func(key string, dur time.Duration, err error) {
+		hooked++
+	}
+	m := NewMetricsCollector(c, "test_cache")
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(m); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Get("a")
+	c.Get("a")
+	c.Get("b")
+	c.Invalidate("b")
+	c.GetWithValueLoader("c", fetchFunc)
+	c.Invalidate("c")
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := make(map[string]float64)
+	for _, f := range families {
+		metric := f.GetMetric()[0]
+		switch {
+		case metric.GetCounter() != nil:
+			values[f.GetName()] = metric.GetCounter().GetValue()
+		case metric.GetGauge() != nil:
+			values[f.GetName()] = metric.GetGauge().GetValue()
+		case metric.GetHistogram() != nil:
+			values[f.GetName()] = float64(metric.GetHistogram().GetSampleCount())
+		}
+	}
+
+	expected := map[string]float64{
+		"test_cache_hits_total":            1,
+		"test_cache_misses_total":          3,
+		"test_cache_evictions_total":       2,
+		"test_cache_length":                1,
+		"test_cache_load_duration_seconds": 3,
+	}
+	for name, want := range expected {
+		got, ok := values[name]
+		if !ok {
+			t.Error("Missing metric family", name)
+			continue
+		}
+		if got != want {
+			t.Error("Metric", name, "should be", want, "got", got)
+		}
+	}
+	if hooked != 3 {
+		t.Error("Should still have called the existing OnLoad, got", hooked)
+	}
+}
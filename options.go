@@ -0,0 +1,179 @@
+package cache
+
+import (
+	"time"
+)
+
+// Option configures a PowerCache built by NewCache, returning ErrInvalidOption
+// for a bad value or ErrOptionConflict if it clashes with an earlier one
+type Option func(c *PowerCache) error
+
+// NewCache builds a PowerCache from options, checks the options make sense
+// together and initializes it so it's ready to use. Giving an option twice
+// with different values is a conflict, and since functions can't be compared
+// so is giving a function option twice. Like the Expires* constructors a cache
+// that expires keys does periodic maintenance every 5 minutes.
+func NewCache(opts ...Option) (*PowerCache, error) {
+	c := new(PowerCache)
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	//Both need something to evict for
+	if c.AdmissionFilter && c.MaxKeys == 0 {
+		return nil, ErrOptionConflict
+	}
+	if c.EvictionSampleSize > 0 && c.MaxKeys == 0 && c.MaxWeight == 0 {
+		return nil, ErrOptionConflict
+	}
+	if c.hasExpiry() {
+		c.PeriodicMaintenance = time.Minute * 5
+	}
+	c.Initialize()
+	return c, nil
+}
+
+func WithMaxKeys(maxKeys int) Option {
+	return func(c *PowerCache) error {
+		if maxKeys <= 0 {
+			return ErrInvalidOption
+		}
+		if c.MaxKeys != 0 && c.MaxKeys != maxKeys {
+			return ErrOptionConflict
+		}
+		c.MaxKeys = maxKeys
+		return nil
+	}
+}
+
+func WithMaxWeight(maxWeight int64) Option {
+	return func(c *PowerCache) error {
+		if maxWeight <= 0 {
+			return ErrInvalidOption
+		}
+		if c.MaxWeight != 0 && c.MaxWeight != maxWeight {
+			return ErrOptionConflict
+		}
+		c.MaxWeight = maxWeight
+		return nil
+	}
+}
+
+func WithExpireAfterWrite(d time.Duration) Option {
+	return func(c *PowerCache) error {
+		if d <= 0 {
+			return ErrInvalidOption
+		}
+		if c.ExpiresAfterWriteDuration != emptyDuration && c.ExpiresAfterWriteDuration != d {
+			return ErrOptionConflict
+		}
+		c.ExpiresAfterWriteDuration = d
+		return nil
+	}
+}
+
+func WithExpireAfterAccess(d time.Duration) Option {
+	return func(c *PowerCache) error {
+		if d <= 0 {
+			return ErrInvalidOption
+		}
+		if c.ExpiresAfterAccessDuration != emptyDuration && c.ExpiresAfterAccessDuration != d {
+			return ErrOptionConflict
+		}
+		c.ExpiresAfterAccessDuration = d
+		return nil
+	}
+}
+
+func WithMaxAge(d time.Duration) Option {
+	return func(c *PowerCache) error {
+		if d <= 0 {
+			return ErrInvalidOption
+		}
+		if c.MaxAge != emptyDuration && c.MaxAge != d {
+			return ErrOptionConflict
+		}
+		c.MaxAge = d
+		return nil
+	}
+}
+
+// WithEvictionFactors sets WeightFactor and AgeFactor, which mustn't be
+// negative or both 0
+func WithEvictionFactors(weightFactor, ageFactor float64) Option {
+	return func(c *PowerCache) error {
+		if weightFactor < 0 || ageFactor < 0 || weightFactor+ageFactor == 0 {
+			return ErrInvalidOption
+		}
+		if (c.WeightFactor != 0 || c.AgeFactor != 0) && (c.WeightFactor != weightFactor || c.AgeFactor != ageFactor) {
+			return ErrOptionConflict
+		}
+		c.WeightFactor = weightFactor
+		c.AgeFactor = ageFactor
+		return nil
+	}
+}
+
+// WithSampledEviction picks victims from sampleSize random keys, see
+// NewSampledCache
+func WithSampledEviction(sampleSize int) Option {
+	return func(c *PowerCache) error {
+		if sampleSize <= 0 {
+			return ErrInvalidOption
+		}
+		if c.EvictionSampleSize != 0 && c.EvictionSampleSize != sampleSize {
+			return ErrOptionConflict
+		}
+		c.EvictionSampleSize = sampleSize
+		return nil
+	}
+}
+
+// WithAdmissionFilter turns on the TinyLFU style admission filter, see
+// NewTinyLFUCache
+func WithAdmissionFilter() Option {
+	return func(c *PowerCache) error {
+		c.AdmissionFilter = true
+		return nil
+	}
+}
+
+func WithWeigher(weigher Weigher) Option {
+	return func(c *PowerCache) error {
+		if weigher == nil {
+			return ErrInvalidOption
+		}
+		if c.Weigher != nil {
+			return ErrOptionConflict
+		}
+		c.Weigher = weigher
+		return nil
+	}
+}
+
+func WithLoader(valueLoader ValueLoader) Option {
+	return func(c *PowerCache) error {
+		if valueLoader == nil {
+			return ErrInvalidOption
+		}
+		if c.ValueLoader != nil {
+			return ErrOptionConflict
+		}
+		c.ValueLoader = valueLoader
+		return nil
+	}
+}
+
+func WithRemovalListener(listener RemovalListener) Option {
+	return func(c *PowerCache) error {
+		if listener == nil {
+			return ErrInvalidOption
+		}
+		if c.RemovalListener != nil {
+			return ErrOptionConflict
+		}
+		c.RemovalListener = listener
+		return nil
+	}
+}
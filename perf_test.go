@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"sort"
 	"strconv"
 	"testing"
 	"time"
@@ -25,3 +26,193 @@ func BenchmarkTimeBasedCache1000(b *testing.B) {
 		c.GetWithValueLoader(key, fetchFunc)
 	}
 }
+
+func benchmarkMaxKeysPut(b *testing.B, keys int) {
+	c := NewMaxKeysCache(keys)
+	for i := 0; i < keys; i++ {
+		c.Put(strconv.Itoa(i), i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		//Every put is a new key so every put has to evict
+		c.Put(strconv.Itoa(keys+i), i)
+	}
+}
+
+func benchmarkBatchedPut(b *testing.B, batch int) {
+	//Every CleanUp of an expiring cache sweeps for expired keys as well, which
+	//is what batching saves on
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Hour
+	c.MaxKeys = 10000
+	c.EvictBatchSize = batch
+	for i := 0; i < c.MaxKeys; i++ {
+		c.Put(strconv.Itoa(i), i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Put(strconv.Itoa(c.MaxKeys+i), i)
+	}
+}
+
+func BenchmarkEvictBatchSize1(b *testing.B) {
+	benchmarkBatchedPut(b, 1)
+}
+
+func BenchmarkEvictBatchSize1000(b *testing.B) {
+	benchmarkBatchedPut(b, 1000)
+}
+
+func BenchmarkMaxKeysPut1000(b *testing.B) {
+	benchmarkMaxKeysPut(b, 1000)
+}
+
+func BenchmarkMaxKeysPut10000(b *testing.B) {
+	benchmarkMaxKeysPut(b, 10000)
+}
+
+func BenchmarkMaxKeysPut100000(b *testing.B) {
+	benchmarkMaxKeysPut(b, 100000)
+}
+
+func BenchmarkParallelHits(b *testing.B) {
+	c := NewPowerCache()
+	for i := 0; i < 10; i++ {
+		c.Put(strconv.Itoa(i), i)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			c.GetIfPresent(strconv.Itoa(i % 10))
+			i++
+		}
+	})
+}
+
+func benchmarkCleanUp(b *testing.B, keys int, maxScan int) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Hour
+	c.MaxCleanUpScan = maxScan
+	for i := 0; i < keys; i++ {
+		c.Put(strconv.Itoa(i), i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.CleanUp()
+	}
+}
+
+func BenchmarkCleanUp10000(b *testing.B) {
+	benchmarkCleanUp(b, 10000, 0)
+}
+
+func BenchmarkCleanUp100000(b *testing.B) {
+	benchmarkCleanUp(b, 100000, 0)
+}
+
+func BenchmarkCleanUpCapped10000(b *testing.B) {
+	benchmarkCleanUp(b, 10000, 100)
+}
+
+func BenchmarkCleanUpCapped100000(b *testing.B) {
+	benchmarkCleanUp(b, 100000, 100)
+}
+
+func benchmarkPutAll(b *testing.B, initialCapacity int) {
+	values := make(map[string]interface{})
+	for i := 0; i < 10000; i++ {
+		values[strconv.Itoa(i)] = i
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := new(PowerCache)
+		c.InitialCapacity = initialCapacity
+		c.Initialize()
+		c.PutAll(values)
+	}
+}
+
+func BenchmarkPutAllDefault10000(b *testing.B) {
+	benchmarkPutAll(b, 0)
+}
+
+func BenchmarkPutAllPresized10000(b *testing.B) {
+	benchmarkPutAll(b, 10000)
+}
+
+func BenchmarkGetIfPresentHit(b *testing.B) {
+	c := NewExpiresAfterAccessCache(time.Hour)
+	for i := 0; i < 10; i++ {
+		c.Put(strconv.Itoa(i), i)
+	}
+	keys := make([]string, 10)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.GetIfPresent(keys[i%10])
+	}
+}
+
+func benchmarkBytesKeys() []string {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	return keys
+}
+
+func BenchmarkPutBytesInterface(b *testing.B) {
+	c := NewPowerCache()
+	keys := benchmarkBytesKeys()
+	value := []byte("value")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Put(keys[i%len(keys)], value)
+	}
+}
+
+func BenchmarkPutBytesCache(b *testing.B) {
+	c := NewBytesCache(NewPowerCache())
+	keys := benchmarkBytesKeys()
+	value := []byte("value")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Put(keys[i%len(keys)], value)
+	}
+}
+
+// benchmarkPutTail reports the p99 Put latency on a big expiring cache that's
+// due for maintenance on every Put, which makes each inline clean up a full scan
+func benchmarkPutTail(b *testing.B, background bool) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Hour
+	c.BackgroundCleanUp = background
+	for i := 0; i < 10000; i++ {
+		c.Put(strconv.Itoa(i), i)
+	}
+	c.PeriodicMaintenance = time.Nanosecond
+	lat := make([]time.Duration, b.N)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		c.Put(strconv.Itoa(i%10000), i)
+		lat[i] = time.Since(start)
+	}
+	b.StopTimer()
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+	b.ReportMetric(float64(lat[len(lat)*99/100].Nanoseconds()), "p99-ns")
+}
+
+func BenchmarkPutTailInlineCleanUp(b *testing.B) {
+	benchmarkPutTail(b, false)
+}
+
+func BenchmarkPutTailBackgroundCleanUp(b *testing.B) {
+	benchmarkPutTail(b, true)
+}
@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"encoding/gob"
+	"io"
+	"time"
+)
+
+type persistedEntry struct {
+	Key      string
+	Value    interface{}
+	Wtime    time.Time
+	Atime    time.Time
+	Deadline time.Time
+	Weight   int64
+	Meta     interface{}
+}
+
+// SaveToWriter gob encodes every entry along with its timestamp and weight.
+// Values are stored as interface{}, so any concrete type other than the gob
+// builtins must be registered with gob.Register before saving or loading.
+func (c *PowerCache) SaveToWriter(w io.Writer) error {
+	c.mu.RLock()
+	entries := c.entries()
+	c.mu.RUnlock()
+	return gob.NewEncoder(w).Encode(entries)
+}
+
+// entries copies out every entry with its metadata. The caller must hold the
+// lock.
+func (c *PowerCache) entries() []persistedEntry {
+	entries := make([]persistedEntry, 0, len(c.values))
+	for k := range c.values {
+		entries = append(entries, persistedEntry{
+			Key:      k,
+			Value:    c.valueOf(k),
+			Wtime:    c.wtime[k],
+			Atime:    c.atime[k],
+			Deadline: c.deadline[k],
+			Weight:   c.weight[k],
+			Meta:     c.meta[k],
+		})
+	}
+	return entries
+}
+
+// LoadFromReader restores entries written by SaveToWriter into the cache.
+// Entries that have expired since they were saved are discarded, and once
+// everything is in the cache is evicted back down to its limits. Entries that
+// replace existing keys are reported to the RemovalListener as Replaced. A
+// cache wrapped by a BytesCache or StringCache skips values of any other type.
+func (c *PowerCache) LoadFromReader(r io.Reader) error {
+	var entries []persistedEntry
+	if err := gob.NewDecoder(r).Decode(&entries); err != nil {
+		return err
+	}
+	c.restore(entries)
+	return nil
+}
+
+// CacheState is an in memory copy of every entry in a cache along with its
+// timestamps, deadline and weight, taken by Snapshot
+type CacheState struct {
+	entries []persistedEntry
+}
+
+// Len is the number of entries in the snapshot
+func (s *CacheState) Len() int {
+	return len(s.entries)
+}
+
+// Snapshot copies every entry in the cache so it can be restored into
+// another cache with Restore. Unlike SaveToWriter nothing is encoded, so
+// values keep their types without gob.Register, but they are shared with the
+// cache unless it has a CloneFunc.
+func (c *PowerCache) Snapshot() *CacheState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return &CacheState{c.entries()}
+}
+
+// Restore puts the entries of a Snapshot into the cache the same way as
+// LoadFromReader. Entries keep the timestamps, deadlines and weights they had
+// in the snapshot, so they expire when they would have in the original.
+func (c *PowerCache) Restore(state *CacheState) {
+	c.restore(state.entries)
+}
+
+func (c *PowerCache) restore(entries []persistedEntry) {
+	c.ensureInitialized()
+	c.mu.Lock()
+	var removed []removal
+	now := time.Now()
+	for _, e := range entries {
+		//A typed cache can only take back values of its own type
+		if c.store != nil && !c.store.accepts(e.Value) {
+			continue
+		}
+		if _, ok := c.values[e.Key]; ok && c.RemovalListener != nil {
+			removed = append(removed, removal{e.Key, c.valueOf(e.Key), Replaced})
+		}
+		c.remove(e.Key)
+		if c.store != nil {
+			c.values[e.Key] = nil
+			c.store.unbox(e.Key, e.Value)
+		} else {
+			c.values[e.Key] = c.encode(e.Value)
+		}
+		c.stamp(e.Key)
+		c.wtime[e.Key] = e.Wtime
+		c.atime[e.Key] = e.Atime
+		c.rtime[e.Key] = e.Atime
+		if !e.Deadline.IsZero() {
+			c.deadline[e.Key] = e.Deadline
+		}
+		c.weight[e.Key] = e.Weight
+		if e.Meta != nil {
+			c.meta[e.Key] = e.Meta
+		}
+		c.totalWeight += e.Weight
+		c.measure(e.Key, c.values[e.Key])
+		if c.isExpired(e.Key, now) {
+			c.remove(e.Key)
+			continue
+		}
+		c.evict.track(e.Key)
+	}
+	//A restore can bring in more than the limits allow
+	removed = c.evictOverLimits(removed)
+	c.mu.Unlock()
+	c.notify(removed)
+}
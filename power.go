@@ -1,6 +1,12 @@
 package cache
 
 import (
+	"container/heap"
+	"errors"
+	"math"
+	"math/bits"
+	"reflect"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -8,47 +14,204 @@ import (
 
 var emptyDuration time.Duration
 
+// PowerCache is the implementation behind every constructor. The zero value is
+// ready to use, it initializes itself the first time it is written to.
 type PowerCache struct {
 	ValueLoader                ValueLoader
+	RemovalListener            RemovalListener
+	OnLoad                     LoadHook
+	Comparer                   Comparer
+	Weigher                    Weigher
+	Sizer                      Sizer
+	CloneFunc                  CloneFunc
+	Encoder                    Encoder
+	Decoder                    Decoder
+	KeyNormalizer              KeyNormalizer
 	ExpiresAfterAccessDuration time.Duration
 	ExpiresAfterWriteDuration  time.Duration
+	MaxAge                     time.Duration
+	MaxIdle                    time.Duration
+	NegativeTTL                time.Duration
+	ErrorTTL                   time.Duration
+	LoadTimeout                time.Duration
 	PeriodicMaintenance        time.Duration
+	MinMaintenance             time.Duration
+	MaxMaintenance             time.Duration
+	RefreshInterval            time.Duration
 	MaxKeys                    int
+	SoftMaxKeys                int
+	InitialCapacity            int
+	MaxConcurrentLoads         int
+	MaxCleanUpScan             int
+	EvictionSampleSize         int
+	EvictBatchSize             int
+	HitRateWindow              int
 	MaxWeight                  int64
+	MaxEntryWeight             int64
 	MaxSize                    int64
 	DefaultValueWeight         int64
+	WeightFactor               float64
+	AgeFactor                  float64
+	PenalizeLoadFailures       bool
+	AdmissionFilter            bool
+	TrackKeyStats              bool
+	TrackLoadDurations         bool
+	PerKeyExpiry               bool
+	ReloadOnPut                bool
+	StaleWhileRevalidate       bool
+	ServeStaleOnError          bool
+	BackgroundCleanUp          bool
 
 	mu           sync.RWMutex
 	values       map[string]interface{}
-	tstamp       map[string]time.Time
+	wtime        map[string]time.Time
+	atime        map[string]time.Time
+	rtime        map[string]time.Time
+	deadline     map[string]time.Time
+	negative     map[string]time.Time
+	failed       map[string]failedLoad
+	keyStats     map[string]*KeyStat
+	reloads      map[string]bool
+	revalidating map[string]bool
+	trimming     bool
+	cleaning     bool
+	window       []bool
+	windowNext   int
+	windowHits   int
 	weight       map[string]int64
+	meta         map[string]interface{}
+	version      map[string]uint64
+	lastVersion  uint64
+	pinned       map[string]bool
+	size         map[string]int64
 	cacheSizeEst int64
+	totalWeight  int64
+	evict        evictionHeap
+	sketch       *frequencySketch
+	loadSlots    chan struct{}
 	nextClean    time.Time
+	maintenance  time.Duration
+	nextNegSweep time.Time
+	closing      chan struct{}
+	closed       chan struct{}
+	lazy         sync.Once
+	store        valueStore
 
-	statLoadCount int64
-	statLoadDur   time.Duration
-	statHits      int64
-	statReqs      int64
-	statEvictions int64
+	statLoadCount     int64
+	statLoadDur       int64
+	statLoadFailCount int64
+	statLoadFailDur   int64
+	statHits          int64
+	statReqs          int64
+	statEvictions     int64
+	statCauses        [Size + 1]int64
+	statLoadHist      [loadBuckets]int64
+	statLoadFailHist  [loadBuckets]int64
 }
 
+// loadBuckets is how many buckets load durations are counted in. Bucket i
+// holds loads that took under 2^i microseconds, and the last one everything
+// longer, which is over half an hour.
+const loadBuckets = 32
+
 func (c *PowerCache) Initialize() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.values = make(map[string]interface{})
-	c.tstamp = make(map[string]time.Time)
-	c.weight = make(map[string]int64)
+	//Presize the per key maps so warming up doesn't keep rehashing
+	c.values = make(map[string]interface{}, c.InitialCapacity)
+	c.wtime = make(map[string]time.Time, c.InitialCapacity)
+	c.atime = make(map[string]time.Time, c.InitialCapacity)
+	c.rtime = make(map[string]time.Time, c.InitialCapacity)
+	c.deadline = make(map[string]time.Time)
+	c.negative = make(map[string]time.Time)
+	c.failed = make(map[string]failedLoad)
+	c.weight = make(map[string]int64, c.InitialCapacity)
+	c.meta = make(map[string]interface{})
+	c.version = make(map[string]uint64)
+	c.reloads = make(map[string]bool)
+	c.revalidating = make(map[string]bool)
+	c.pinned = make(map[string]bool)
+	c.size = make(map[string]int64)
+	c.totalWeight = 0
+	c.cacheSizeEst = 0
+	if c.store != nil {
+		c.store.dropAll()
+	}
+	c.evict = evictionHeap{
+		c:        c,
+		keys:     make([]string, 0, c.InitialCapacity),
+		index:    make(map[string]int, c.InitialCapacity),
+		priority: make(map[string]float64, c.InitialCapacity),
+	}
 	if c.DefaultValueWeight == 0 {
 		c.DefaultValueWeight = 1
 	}
+	if c.AdmissionFilter {
+		c.sketch = newFrequencySketch(c.MaxKeys)
+	}
+	if c.MaxConcurrentLoads > 0 {
+		c.loadSlots = make(chan struct{}, c.MaxConcurrentLoads)
+	}
 	if c.PeriodicMaintenance != emptyDuration {
+		c.maintenance = c.PeriodicMaintenance
 		c.nextClean = time.Now().Add(c.PeriodicMaintenance)
 	}
 
-	c.statLoadCount = 0
-	c.statHits = 0
-	c.statReqs = 0
-	c.statEvictions = 0
+	c.resetStats()
+	if c.RefreshInterval != emptyDuration && c.closing == nil {
+		t := time.NewTicker(c.RefreshInterval)
+		c.startRefresher(t.C, t.Stop)
+	}
+}
+
+// normalize maps a key onto the one it is stored under with the
+// KeyNormalizer, if there is one
+func (c *PowerCache) normalize(key string) string {
+	if c.KeyNormalizer == nil {
+		return key
+	}
+	return c.KeyNormalizer(key)
+}
+
+// ensureInitialized lets a zero value PowerCache work as if Initialize had
+// been called, rather than panicking on its nil maps the first time it's
+// written to. Everything that writes to the maps calls it first.
+func (c *PowerCache) ensureInitialized() {
+	c.lazy.Do(func() {
+		c.mu.RLock()
+		ready := c.values != nil
+		c.mu.RUnlock()
+		if !ready {
+			c.Initialize()
+		}
+	})
+}
+
+// ResetStats zeroes every stat counter while leaving the entries intact
+func (c *PowerCache) ResetStats() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resetStats()
+}
+
+// resetStats expects the caller to hold the lock
+func (c *PowerCache) resetStats() {
+	atomic.StoreInt64(&c.statLoadCount, 0)
+	atomic.StoreInt64(&c.statLoadDur, 0)
+	atomic.StoreInt64(&c.statLoadFailCount, 0)
+	atomic.StoreInt64(&c.statLoadFailDur, 0)
+	atomic.StoreInt64(&c.statHits, 0)
+	atomic.StoreInt64(&c.statReqs, 0)
+	atomic.StoreInt64(&c.statEvictions, 0)
+	c.keyStats = make(map[string]*KeyStat)
+	c.window, c.windowNext, c.windowHits = nil, 0, 0
+	for i := range c.statCauses {
+		atomic.StoreInt64(&c.statCauses[i], 0)
+	}
+	for i := 0; i < loadBuckets; i++ {
+		atomic.StoreInt64(&c.statLoadHist[i], 0)
+		atomic.StoreInt64(&c.statLoadFailHist[i], 0)
+	}
 }
 
 func (c *PowerCache) Length() int {
@@ -57,291 +220,1968 @@ func (c *PowerCache) Length() int {
 	return len(c.values)
 }
 
+// LengthByExpiry splits Length into the live entries and the stale ones,
+// which are past their deadline but still take up room until a read or a
+// CleanUp sweeps them out
+func (c *PowerCache) LengthByExpiry() (int, int) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.hasExpiry() {
+		return len(c.values), 0
+	}
+	now := time.Now()
+	stale := 0
+	for k := range c.values {
+		if c.isExpired(k, now) {
+			stale++
+		}
+	}
+	return len(c.values) - stale, stale
+}
+
+// WeightedSize is the sum of the weights of every entry
+func (c *PowerCache) WeightedSize() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.totalWeight
+}
+
+// Size is the sum of every value's size as measured by the Sizer, which is
+// what MaxSize is compared against. It is always 0 without a Sizer.
+func (c *PowerCache) Size() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cacheSizeEst
+}
+
 func (c *PowerCache) cleanUpIfNeccissary() {
+	//With BackgroundCleanUp it's left to maintainInBackground
+	if c.BackgroundCleanUp {
+		return
+	}
 	c.mu.RLock()
+	shouldClean := c.needsCleanUp()
+	c.mu.RUnlock()
+	if shouldClean {
+		c.CleanUp()
+	}
+}
+
+// needsCleanUp reports whether periodic maintenance is due or the cache is
+// at its limits. The caller must hold the lock.
+func (c *PowerCache) needsCleanUp() bool {
 	shouldClean := false
 	//Do periodic maintenence if this is a time based cache
 	if c.PeriodicMaintenance != emptyDuration {
-		if c.nextClean.After(time.Now()) {
+		if time.Now().After(c.nextClean) {
 			shouldClean = true
 		}
 	}
-	//If maxkeys is set and we are at (or possibly approaching) the limit, clean
-	if c.MaxKeys != 0 && len(c.values) >= c.MaxKeys {
+	//If maxkeys, maxsize or maxweight is set and we are at (or possibly approaching) the limit, clean
+	//The admission filter makes room itself, but only for keys it lets in
+	if c.sketch == nil && c.overLimits() {
 		shouldClean = true
 	}
-	//If maxsize is set and we are at (or possibly approaching) the limit, clean
-	if c.MaxSize != 0 && c.cacheSizeEst >= c.MaxSize {
-		shouldClean = true
+	return shouldClean
+}
+
+// maintainInBackground is deferred by every writer, so it runs once the write
+// is in. Past the soft limit the hot path leaves trimming to the background,
+// as does BackgroundCleanUp with the whole clean up. Started any earlier, the
+// work could finish before the write lands and leave the cache over a limit.
+func (c *PowerCache) maintainInBackground() {
+	if c.SoftMaxKeys == 0 && !c.BackgroundCleanUp {
+		return
 	}
-	//Clean
+	c.mu.RLock()
+	shouldClean := c.BackgroundCleanUp && !c.cleaning && c.needsCleanUp()
+	shouldTrim := c.SoftMaxKeys > 0 && len(c.values) > c.SoftMaxKeys && !c.trimming
 	c.mu.RUnlock()
 	if shouldClean {
-		c.CleanUp()
+		c.cleanUpInBackground()
+	}
+	if shouldTrim {
+		c.trimInBackground()
 	}
 }
 
-func (c *PowerCache) Put(key string, value interface{}) {
-	c.cleanUpIfNeccissary()
+// cleanUpInBackground runs CleanUp on its own goroutine for a cache with
+// BackgroundCleanUp set, unless one is already running, so a Put that finds
+// maintenance due never does it itself. The cache can go over its limits until
+// the clean up gets the lock. The clean up clears the flag under the same lock
+// it evicts under, so a write that lands afterwards always sees it isn't
+// running.
+func (c *PowerCache) cleanUpInBackground() {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.values[key] = value
-	if c.ExpiresAfterWriteDuration == emptyDuration && c.ExpiresAfterAccessDuration == emptyDuration {
-		c.tstamp[key] = time.Now()
+	if c.cleaning {
+		c.mu.Unlock()
+		return
 	}
-	if c.ExpiresAfterWriteDuration != emptyDuration {
-		c.tstamp[key] = time.Now().Add(c.ExpiresAfterWriteDuration)
-	}
-	if c.ExpiresAfterAccessDuration != emptyDuration {
-		c.tstamp[key] = time.Now().Add(c.ExpiresAfterAccessDuration)
-	}
-	//Put in the weight
-	c.weight[key] = c.DefaultValueWeight
-	//TODO Use the weight calculator function if it's available
+	c.cleaning = true
+	c.mu.Unlock()
+	go c.cleanUp(c.MaxCleanUpScan, true)
 }
 
-func (c *PowerCache) loadWithValueLoader(key string, valueLoader ValueLoader) (interface{}, error) {
-	start := time.Now()
-	value, err := valueLoader(key)
-	if err != nil {
-		return nil, err
-	}
-	loaddur := time.Now().Sub(start)
-	//Update Average Load Duration
-	atomic.AddInt64(&c.statLoadCount, 1)
+// trimInBackground evicts down to SoftMaxKeys on its own goroutine, unless
+// that's already happening. Puts only evict inline once the cache reaches
+// MaxKeys, the hard limit. The trim is done and the flag cleared under one
+// lock, so a write that lands afterwards always sees it isn't running.
+func (c *PowerCache) trimInBackground() {
 	c.mu.Lock()
-	c.statLoadDur = (c.statLoadDur + loaddur) / time.Duration(c.statLoadCount)
+	if c.trimming {
+		c.mu.Unlock()
+		return
+	}
+	c.trimming = true
 	c.mu.Unlock()
-	c.Put(key, value)
-	return value, nil
+	go func() {
+		c.mu.Lock()
+		var removed []removal
+		for len(c.values) > c.SoftMaxKeys {
+			victim, ok := c.findVictim()
+			if !ok {
+				break
+			}
+			c.evict.raiseFloor(victim)
+			removed = c.discard(victim, Size, removed)
+		}
+		c.trimming = false
+		c.mu.Unlock()
+		c.notify(removed)
+	}()
 }
 
-func (c *PowerCache) Refresh(key string) {
-	c.loadWithValueLoader(key, c.ValueLoader)
+// Put stores the value. With ReloadOnPut set it also has the ValueLoader
+// reload the key in the background, for when a Put just marks the key dirty.
+func (c *PowerCache) Put(key string, value interface{}) {
+	key = c.normalize(key)
+	c.write(key, value)
+	if c.ReloadOnPut && c.ValueLoader != nil {
+		c.reloadInBackground(key)
+	}
 }
 
-func (c *PowerCache) Load(key string) (interface{}, error) {
-	return c.GetWithValueLoader(key, c.ValueLoader)
+// write is Put without ReloadOnPut, which is how loaded values are stored
+func (c *PowerCache) write(key string, value interface{}) {
+	c.ensureInitialized()
+	c.cleanUpIfNeccissary()
+	defer c.maintainInBackground()
+	c.mu.Lock()
+	removed := c.put(key, value)
+	c.mu.Unlock()
+	c.notify(removed)
 }
 
-func (c *PowerCache) GetIfPresent(key string) (interface{}, error) {
-	if c.isKeyExpired(key) {
-		c.Invalidate(key)
+// reloadInBackground starts a reload of the key unless one is already
+// running. A Put that arrives while it runs may have been loaded too early,
+// so the running reload is marked to go round once more instead.
+func (c *PowerCache) reloadInBackground(key string) {
+	c.mu.Lock()
+	_, running := c.reloads[key]
+	c.reloads[key] = running
+	c.mu.Unlock()
+	if running {
+		return
 	}
-	atomic.AddInt64(&c.statReqs, 1)
-	c.mu.RLock()
-	v, ok := c.values[key]
-	c.mu.RUnlock()
-	if ok {
-		if c.ExpiresAfterWriteDuration == emptyDuration && c.ExpiresAfterAccessDuration == emptyDuration {
+	go func() {
+		for {
+			c.loadWithValueLoader(key, c.ValueLoader)
 			c.mu.Lock()
-			c.tstamp[key] = time.Now()
-			c.mu.Unlock()
-		} else if c.ExpiresAfterAccessDuration != emptyDuration {
-			c.mu.Lock()
-			c.tstamp[key] = time.Now().Add(c.ExpiresAfterAccessDuration)
+			if !c.reloads[key] {
+				delete(c.reloads, key)
+				c.mu.Unlock()
+				return
+			}
+			c.reloads[key] = false
 			c.mu.Unlock()
 		}
-		atomic.AddInt64(&c.statHits, 1)
-		return v, nil
-	} else {
-		return nil, ErrNotPresent
+	}()
+}
+
+// PutAll stores every value under a single lock, evicting back down to the
+// limits before it's released if the batch went over them. With
+// BackgroundCleanUp that's left to a background clean up instead.
+func (c *PowerCache) PutAll(values map[string]interface{}) {
+	c.ensureInitialized()
+	c.cleanUpIfNeccissary()
+	defer c.maintainInBackground()
+	c.mu.Lock()
+	var removed []removal
+	for k, v := range values {
+		removed = append(removed, c.put(c.normalize(k), v)...)
 	}
+	//The admission filter already made room for every key it let in
+	if c.sketch == nil && !c.BackgroundCleanUp {
+		removed = c.evictOverLimits(removed)
+	}
+	c.mu.Unlock()
+	c.notify(removed)
 }
 
-func (c *PowerCache) Get(key string) (interface{}, error) {
-	return c.GetWithValueLoader(key, c.ValueLoader)
+// PutWithTTL stores the value along with its own deadline under a single
+// lock, so the key is never seen with the default TTL. Like SetExpiresIn the
+// deadline takes the place of the write expiry. Like SetExpiresAt nothing is
+// stored and ErrNoExpiry or ErrExpiresInPast is returned if the cache has no
+// expiry policy to honor the ttl or the ttl isn't positive.
+func (c *PowerCache) PutWithTTL(key string, value interface{}, ttl time.Duration) error {
+	key = c.normalize(key)
+	c.ensureInitialized()
+	c.cleanUpIfNeccissary()
+	defer c.maintainInBackground()
+	c.mu.Lock()
+	//The expiry policy can change at runtime, so it's checked under the lock
+	if !c.hasExpiry() {
+		c.mu.Unlock()
+		return ErrNoExpiry
+	}
+	if ttl <= 0 {
+		c.mu.Unlock()
+		return ErrExpiresInPast
+	}
+	removed := c.put(key, value)
+	if _, ok := c.values[key]; ok {
+		c.deadline[key] = time.Now().Add(ttl)
+		c.evict.track(key)
+	}
+	c.mu.Unlock()
+	c.notify(removed)
+	return nil
 }
 
-func (c *PowerCache) GetWithValueLoader(key string, valueLoader ValueLoader) (interface{}, error) {
-	v, err := c.GetIfPresent(key)
-	if err == nil {
-		return v, err
+// PutChecked is Put that returns ErrWeightTooLarge instead of quietly
+// turning the value away when it weighs more than MaxEntryWeight
+func (c *PowerCache) PutChecked(key string, value interface{}) error {
+	key = c.normalize(key)
+	c.ensureInitialized()
+	c.cleanUpIfNeccissary()
+	defer c.maintainInBackground()
+	c.mu.Lock()
+	value = c.encode(value)
+	w := c.weigh(key, value)
+	removed := c.putWeighed(key, value, w)
+	c.mu.Unlock()
+	c.notify(removed)
+	if c.tooHeavy(w) {
+		return ErrWeightTooLarge
 	}
-	return c.loadWithValueLoader(key, valueLoader)
+	return nil
 }
 
-func (c *PowerCache) isKeyExpired(key string) bool {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	if c.ExpiresAfterAccessDuration != emptyDuration {
-		if a, ok := c.tstamp[key]; ok {
-			if time.Now().After(a.Add(c.ExpiresAfterAccessDuration)) {
-				return true
-			}
-		}
+// ReplaceIfPresent stores the value only if the key is already cached and
+// hasn't expired, returning whether it did. Like Put it counts as a write, so
+// the write expiry starts over. An expired entry found along the way is
+// removed as Expired.
+func (c *PowerCache) ReplaceIfPresent(key string, value interface{}) bool {
+	key = c.normalize(key)
+	c.ensureInitialized()
+	c.mu.Lock()
+	var removed []removal
+	_, ok := c.values[key]
+	if ok && c.isExpired(key, time.Now()) {
+		removed = c.expire(key, removed)
+		ok = false
 	}
-	if c.ExpiresAfterWriteDuration != emptyDuration {
-		if w, ok := c.tstamp[key]; ok {
-			if time.Now().After(w.Add(c.ExpiresAfterWriteDuration)) {
-				return true
-			}
-		}
+	if ok {
+		removed = append(removed, c.put(key, value)...)
 	}
-	return false
+	c.mu.Unlock()
+	c.notify(removed)
+	return ok
 }
 
-func (c *PowerCache) Invalidate(key string) {
+// CompareAndSwap stores new only if the key is cached, hasn't expired and
+// its value is reflect.DeepEqual to old, returning whether it did. The check
+// and the write happen under the same lock, so callers can use it for
+// optimistic updates.
+func (c *PowerCache) CompareAndSwap(key string, old, new interface{}) bool {
+	key = c.normalize(key)
+	c.ensureInitialized()
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	delete(c.values, key)
-	delete(c.tstamp, key)
-	delete(c.weight, key)
-	c.statEvictions++
+	var removed []removal
+	v, ok := c.values[key]
+	if ok && c.isExpired(key, time.Now()) {
+		removed = c.expire(key, removed)
+		ok = false
+	}
+	swapped := ok && reflect.DeepEqual(c.decode(v), old)
+	if swapped {
+		removed = append(removed, c.put(key, new)...)
+	}
+	c.mu.Unlock()
+	c.notify(removed)
+	return swapped
 }
 
-func (c *PowerCache) InvalidateAll() {
+// PutWithMeta stores the value like Put along with metadata about it, such
+// as where it came from or its version, for GetWithMeta to return. The
+// metadata goes with the value, so writing the key again without it drops
+// it, and it's never passed to the Weigher or Sizer.
+func (c *PowerCache) PutWithMeta(key string, value, meta interface{}) {
+	key = c.normalize(key)
+	c.ensureInitialized()
+	c.cleanUpIfNeccissary()
+	defer c.maintainInBackground()
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.statEvictions += int64(len(c.values))
-	c.values = make(map[string]interface{})
-	c.tstamp = make(map[string]time.Time)
-	c.weight = make(map[string]int64)
+	removed := c.put(key, value)
+	if _, ok := c.values[key]; ok && meta != nil {
+		c.meta[key] = meta
+	}
+	c.mu.Unlock()
+	c.notify(removed)
 }
 
-//The CacheMap CleanUp function has a few different eviction behaviors
-//- Time Based Eviction
-// - If the key is expired it will be evicted
-// - If maxKeys is set then the algorithm will search for a value to evict
-//  - It will stop if it finds at least one expired key to evict
-//  - If not it will settle with the LRU (oldest key)
-// - If maxSize is set then the algorithm will search for a value to evict
-//  - It will stop if it finds at least one expired key to evict
-//  - If not it will find the oldest and largest key to remove by calculating a weight
-//- Size Based Eviction
-// - Will try to find oldest and largest key to remove by calculating a weight
-func (c *PowerCache) CleanUp() {
+// GetWithMeta is GetIfPresent that also returns the metadata stored with the
+// value by PutWithMeta, or nil if it was stored without any
+func (c *PowerCache) GetWithMeta(key string) (interface{}, interface{}, error) {
+	key = c.normalize(key)
+	c.ensureInitialized()
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	var aKey string
-	var aWeight int64
-	var aTstamp time.Time
-	for k, _ := range c.values {
-		if c.ExpiresAfterWriteDuration != emptyDuration ||
-			c.ExpiresAfterAccessDuration != emptyDuration {
-
-			if c.tstamp[k].Before(time.Now()) {
-				delete(c.values, k)
-				delete(c.tstamp, k)
-				delete(c.weight, k)
-				c.statEvictions++
-				if c.MaxSize != 0 || c.MaxKeys != 0 {
-					break
-				} else {
-					continue
-				}
-			}
-		}
+	_, removed, err := c.lookup(key, true, time.Now())
+	v, meta := c.values[key], c.meta[key]
+	c.mu.Unlock()
+	c.notify(removed)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.decode(v), meta, nil
+}
 
-		if aKey == "" {
-			aKey = k
-			aWeight = c.weight[k]
-			aTstamp = c.tstamp[k]
-			continue
-		}
+// GetVersioned is GetIfPresent that also returns the version of the value,
+// for PutIfVersion to check
+func (c *PowerCache) GetVersioned(key string) (interface{}, uint64, error) {
+	key = c.normalize(key)
+	c.ensureInitialized()
+	c.mu.Lock()
+	_, removed, err := c.lookup(key, true, time.Now())
+	v, version := c.values[key], c.version[key]
+	c.mu.Unlock()
+	c.notify(removed)
+	if err != nil {
+		return nil, 0, err
+	}
+	return c.decode(v), version, nil
+}
+
+// PutIfVersion stores the value only if the key's version is still
+// expectedVersion, reporting whether it was stored. A version of 0 expects the key to
+// be missing, so it can also be used to add a key nobody else has.
+func (c *PowerCache) PutIfVersion(key string, value interface{}, expectedVersion uint64) bool {
+	key = c.normalize(key)
+	c.ensureInitialized()
+	c.cleanUpIfNeccissary()
+	defer c.maintainInBackground()
+	c.mu.Lock()
+	var removed []removal
+	if _, ok := c.values[key]; ok && c.isExpired(key, time.Now()) {
+		removed = c.expire(key, removed)
+		delete(c.version, key)
+	}
+	//A missing key has no version, so it's 0 here
+	stored := false
+	if c.version[key] == expectedVersion {
+		last := c.lastVersion
+		removed = append(removed, c.put(key, value)...)
+		//The value can still be turned away for its weight or by admission
+		stored = c.version[key] > last
+	}
+	c.mu.Unlock()
+	c.notify(removed)
+	return stored
+}
+
+// stamp gives the key's new value the next version. Versions are never
+// reused, not even by a key that was removed and put again, so a version
+// always names one value. The caller must hold the lock.
+func (c *PowerCache) stamp(key string) {
+	c.lastVersion++
+	c.version[key] = c.lastVersion
+}
+
+// put expects the caller to hold the lock, the replaced value (if any) is
+// returned to be passed to notify once the lock is released
+func (c *PowerCache) put(key string, value interface{}) []removal {
+	value = c.encode(value)
+	return c.putWeighed(key, value, c.weigh(key, value))
+}
+
+// weigh is the weight a value would be given by put
+func (c *PowerCache) weigh(key string, value interface{}) int64 {
+	if c.Weigher != nil {
+		return c.Weigher(key, value)
+	}
+	return c.DefaultValueWeight
+}
+
+// tooHeavy reports whether a single entry of weight w would be turned away
+func (c *PowerCache) tooHeavy(w int64) bool {
+	return c.MaxEntryWeight != 0 && w > c.MaxEntryWeight
+}
 
-		//Find out relative weights
-		mWeight := aWeight
-		if mWeight < c.weight[k] {
-			mWeight = c.weight[k]
+// putWeighed is put once the value has been weighed. A value heavier than
+// MaxEntryWeight isn't stored, and any old value under the key is invalidated
+// so it can't be read in its place.
+func (c *PowerCache) putWeighed(key string, value interface{}, w int64) []removal {
+	var removed []removal
+	if c.tooHeavy(w) {
+		return c.discard(key, Explicit, removed)
+	}
+	if c.sketch != nil {
+		c.sketch.increment(key)
+		var admitted bool
+		if removed, admitted = c.admit(key, removed); !admitted {
+			return removed
+		}
+	}
+	now := time.Now()
+	//Put in the weight, replacing the old value's share of the total
+	if _, ok := c.values[key]; ok {
+		c.totalWeight -= c.weight[key]
+		if c.RemovalListener != nil {
+			removed = append(removed, removal{key, c.valueOf(key), Replaced})
 		}
-		awf := float64(aWeight) / float64(mWeight)
-		bwf := float64(c.weight[k]) / float64(mWeight)
-		//fmt.Println("Weight: ", awf, bwf)
-		now := time.Now()
-		adf := 0.0
-		bdf := 0.0
+	}
+	c.weight[key] = w
+	c.totalWeight += w
+	c.measure(key, value)
+	c.values[key] = value
+	c.stamp(key)
+	c.wtime[key] = now
+	c.atime[key] = now
+	//Only reads count against MaxIdle, a new key starts out as just read
+	if _, ok := c.rtime[key]; !ok {
+		c.rtime[key] = now
+	}
+	//A write replaces any deadline or metadata set for the old value
+	delete(c.deadline, key)
+	delete(c.meta, key)
+	delete(c.negative, key)
+	delete(c.failed, key)
+	c.evict.track(key)
+	return removed
+}
+
+func (c *PowerCache) loadWithValueLoader(key string, valueLoader ValueLoader) (interface{}, error) {
+	return c.load(key, valueLoader, true)
+}
 
-		if c.ExpiresAfterAccessDuration != emptyDuration || c.ExpiresAfterAccessDuration != emptyDuration {
-			//In this case if this key were expired it would have been removed
-			mTstamp := aTstamp
-			if mTstamp.Before(c.tstamp[k]) {
-				mTstamp = c.tstamp[k]
+// load runs the loader and caches what it returns. Unless remember is false
+// a failure is cached too for NegativeTTL or ErrorTTL.
+func (c *PowerCache) load(key string, valueLoader ValueLoader, remember bool) (interface{}, error) {
+	c.ensureInitialized()
+	if valueLoader == nil {
+		return nil, ErrNoLoader
+	}
+	//Wait for a free slot so we don't overwhelm whatever we load from
+	if c.loadSlots != nil {
+		c.loadSlots <- struct{}{}
+	}
+	start := time.Now()
+	value, err := c.callLoader(key, valueLoader)
+	loaddur := time.Now().Sub(start)
+	if err != nil {
+		//Failures are totaled separately so they only count if requested
+		atomic.AddInt64(&c.statLoadFailCount, 1)
+		atomic.AddInt64(&c.statLoadFailDur, int64(loaddur))
+		c.recordLoadDuration(&c.statLoadFailHist, loaddur)
+		//Remember that the key doesn't exist, or that it fails to load, so we
+		//don't ask again for a while
+		negative := errors.Is(err, ErrNotFound) && c.NegativeTTL != emptyDuration
+		if remember && (negative || c.ErrorTTL != emptyDuration) {
+			ttl := c.ErrorTTL
+			if negative {
+				ttl = c.NegativeTTL
 			}
-			adf = float64(aTstamp.Sub(now)) / float64(mTstamp.Sub(now))
-			bdf = float64(c.tstamp[k].Sub(now)) / float64(mTstamp.Sub(now))
-			//fmt.Println("Expires: ", adf, bdf)
-		} else {
-			//In this case all the expires will just be a timestamp of write
-			//Therefor the smaller the better
-			//We will do durations of both parties
-			ad := now.Sub(aTstamp)
-			bd := now.Sub(c.tstamp[k])
-			md := ad
-			if ad < bd {
-				md = bd
+			c.mu.Lock()
+			now := time.Now()
+			//Lots of different failing keys mustn't pile up, so once a ttl
+			//has passed the lapsed ones are swept out
+			if now.After(c.nextNegSweep) {
+				c.pruneNegative(now, 0)
+				c.nextNegSweep = now.Add(ttl)
+			}
+			if negative {
+				c.negative[key] = now.Add(ttl)
+			} else {
+				c.failed[key] = failedLoad{loaderError(key, err), now.Add(ttl)}
 			}
-			adf = float64(ad) / float64(md)
-			bdf = float64(bd) / float64(md)
-			//Now do the multiplactive inverse of each
-			adf = 1.0 / adf
-			bdf = 1.0 / bdf
-			//fmt.Println("Accessed: ", adf, bdf)
+			c.mu.Unlock()
+		}
+		if c.OnLoad != nil {
+			c.OnLoad(key, loaddur, err)
 		}
+		return nil, loaderError(key, err)
+	}
+	//Update Total Load Duration, the average is computed on read
+	atomic.AddInt64(&c.statLoadCount, 1)
+	atomic.AddInt64(&c.statLoadDur, int64(loaddur))
+	c.recordLoadDuration(&c.statLoadHist, loaddur)
+	c.write(key, value)
+	if c.OnLoad != nil {
+		c.OnLoad(key, loaddur, nil)
+	}
+	return value, nil
+}
+
+// callLoader runs the loader, giving up with ErrLoadTimeout if LoadTimeout is
+// set and the loader takes longer. A loader that times out keeps its load slot
+// until it actually returns, and whatever it returns is thrown away.
+func (c *PowerCache) callLoader(key string, valueLoader ValueLoader) (interface{}, error) {
+	release := func() {
+		if c.loadSlots != nil {
+			<-c.loadSlots
+		}
+	}
+	if c.LoadTimeout == emptyDuration {
+		defer release()
+		return valueLoader(key)
+	}
+	type result struct {
+		value interface{}
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer release()
+		v, err := valueLoader(key)
+		done <- result{v, err}
+	}()
+	timer := time.NewTimer(c.LoadTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-timer.C:
+		return nil, ErrLoadTimeout
+	}
+}
+
+// loaderError wraps what a loader returned in a LoaderError for the caller,
+// while OnLoad still sees it as it was. The cache gave up on a timed out load
+// itself, so ErrLoadTimeout is passed on bare.
+func loaderError(key string, err error) error {
+	if err == ErrLoadTimeout {
+		return err
+	}
+	return &LoaderError{key, err}
+}
+
+// Refresh reloads the key with the ValueLoader. Refreshes are maintenance,
+// not requests, so they count as loads but never towards the hit rate.
+func (c *PowerCache) Refresh(key string) {
+	key = c.normalize(key)
+	c.loadWithValueLoader(key, c.ValueLoader)
+}
 
-		//Calculate the scores, higher wins
-		ascore := awf*0.5 + adf*0.5
-		bscore := bwf*0.5 + bdf*0.5
+// RefreshAll reloads every key with the ValueLoader, running up to
+// concurrency loads at once (one at a time if it's less than 2). The returned
+// map holds the error for each key that failed to load, and a key given more
+// than once is only loaded once. Like Refresh it doesn't count towards the hit
+// rate.
+func (c *PowerCache) RefreshAll(keys []string, concurrency int) map[string]error {
+	errs := make(map[string]error)
+	var mu sync.Mutex
+	c.loadAll(keys, concurrency, func(key string, value interface{}, err error) {
+		if err != nil {
+			mu.Lock()
+			errs[key] = err
+			mu.Unlock()
+		}
+	})
+	return errs
+}
 
-		if bscore < ascore {
-			aKey = k
-			aWeight = c.weight[k]
-			aTstamp = c.tstamp[k]
+// loadAll loads every key with the ValueLoader, running up to concurrency
+// loads at once (one at a time if it's less than 2), and hands each result to
+// done. A key that comes up again, or under another name the KeyNormalizer
+// maps onto it, is only loaded and handed over the first time. done is called
+// from the loading goroutines, so several can run at once.
+func (c *PowerCache) loadAll(keys []string, concurrency int, done func(key string, value interface{}, err error)) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if seen[c.normalize(k)] {
+			continue
 		}
+		seen[c.normalize(k)] = true
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(key string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			v, err := c.loadWithValueLoader(c.normalize(key), c.ValueLoader)
+			done(key, v, err)
+		}(k)
 	}
-	//Now I've gone through, none were immediate canidates for cleaning, so we'll go with our worst guy
-	//fmt.Println("Cleaning: ", aKey)
-	delete(c.values, aKey)
-	delete(c.tstamp, aKey)
-	delete(c.weight, aKey)
-	c.statEvictions++
+	wg.Wait()
+}
 
-	//Now set the time for the next cleaning
-	if c.PeriodicMaintenance != emptyDuration {
-		c.nextClean = time.Now().Add(c.PeriodicMaintenance)
+// WarmUp loads the keys that aren't already cached with the ValueLoader,
+// leaving present entries alone, and returns the error for each key that
+// failed to load. Loads run MaxConcurrentLoads at a time like the background
+// refresh, and checking for a key counts as a request no more than a refresh
+// does.
+func (c *PowerCache) WarmUp(keys []string) map[string]error {
+	c.ensureInitialized()
+	now := time.Now()
+	var missing []string
+	c.mu.RLock()
+	for _, k := range keys {
+		nk := c.normalize(k)
+		if _, ok := c.values[nk]; !ok || c.isExpired(nk, now) {
+			missing = append(missing, k)
+		}
 	}
+	c.mu.RUnlock()
+	return c.RefreshAll(missing, c.MaxConcurrentLoads)
 }
 
-func (c *PowerCache) SetExpiresAt(key string, expires time.Time) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	//TODO Make sure that the cache is set up for future expires
-	//TODO Make sure that the expires is in the future
-	c.tstamp[key] = expires
+func (c *PowerCache) Load(key string) (interface{}, error) {
+	return c.GetWithValueLoader(key, c.ValueLoader)
 }
 
-func (c *PowerCache) SetExpiresIn(key string, expiresIn time.Duration) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	//TODO Make sure thtat the cache is set up for future expires
-	//TODO Make sure that the expires is in the future
-	c.tstamp[key] = time.Now().Add(expiresIn)
+// GetIfPresent returns ErrNotPresent if the key isn't cached. A nil value
+// that was explicitly cached comes back as nil with a nil error.
+func (c *PowerCache) GetIfPresent(key string) (interface{}, error) {
+	v, _, err := c.getIfPresent(key, true)
+	return v, err
+}
+
+// GetIfPresentNoTouch is GetIfPresent without resetting the access time, so
+// peeking at an entry doesn't keep it alive. It still counts towards the stats.
+func (c *PowerCache) GetIfPresentNoTouch(key string) (interface{}, error) {
+	v, _, err := c.getIfPresent(key, false)
+	return v, err
 }
 
-func (c *PowerCache) SetWeight(key string, weight int64) {
+// getIfPresent also returns the entry's ttl as of the read, worked out under
+// the same lock so it can't be invalidated in between
+func (c *PowerCache) getIfPresent(key string, touch bool) (interface{}, time.Duration, error) {
+	c.ensureInitialized()
+	key = c.normalize(key)
+	//Everything is done in one critical section so a read only locks once
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	//TODO Make sure the weight is not above the maxweight
-	c.weight[key] = weight
+	ttl, removed, err := c.lookup(key, touch, time.Now())
+	v := c.values[key]
+	c.mu.Unlock()
+	c.notify(removed)
+	if err != nil {
+		return nil, 0, err
+	}
+	return c.decode(v), ttl, nil
 }
 
-func (c *PowerCache) HitRate() float64 {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	if c.statReqs == 0 {
-		return 0.0
+// lookup does the bookkeeping for a read: an expired entry is discarded,
+// the request is counted and a hit is touched. It returns ErrNotPresent,
+// ErrNotFound or the error of a failed load if there's nothing to read. The
+// caller must hold the lock.
+func (c *PowerCache) lookup(key string, touch bool, now time.Time) (time.Duration, []removal, error) {
+	_, ok := c.values[key]
+	var removed []removal
+	if ok && c.isExpired(key, now) {
+		removed = c.expire(key, nil)
+		ok = false
+	}
+	if !ok {
+		//The loader recently said the key doesn't exist, until NegativeTTL passes
+		if n, neg := c.negative[key]; neg {
+			if now.Before(n) {
+				c.record(key, true)
+				//Wrapped like the load it remembers, the same as ErrorTTL
+				return 0, removed, loaderError(key, ErrNotFound)
+			}
+			delete(c.negative, key)
+		}
+		//The last load failed, hand back its error until ErrorTTL passes
+		if f, failed := c.failed[key]; failed {
+			if now.Before(f.until) {
+				c.record(key, false)
+				return 0, removed, f.err
+			}
+			delete(c.failed, key)
+		}
+		c.record(key, false)
+		return 0, removed, ErrNotPresent
 	}
-	return float64(c.statHits) / float64(c.statReqs)
+	if touch {
+		c.touch(key, now)
+	}
+	c.record(key, true)
+	return c.ttlOf(key, now), removed, nil
 }
 
-func (c *PowerCache) AverageLoadPenalty() time.Duration {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	return c.statLoadDur
+// Range calls f with every present entry until it returns false. The keys
+// are copied out first and each value looked up as it's visited, so the lock
+// is never held while f runs and f is free to use the cache. Entries added
+// after Range starts aren't visited, and ones removed or expired before their
+// turn are skipped. Visiting doesn't touch entries or count as requests.
+func (c *PowerCache) Range(f func(key string, value interface{}) bool) {
+	for _, k := range c.keys() {
+		c.mu.RLock()
+		var v interface{}
+		_, ok := c.values[k]
+		if ok && c.isExpired(k, time.Now()) {
+			ok = false
+		} else if ok {
+			v = c.valueOf(k)
+		}
+		c.mu.RUnlock()
+		if ok && !f(k, v) {
+			return
+		}
+	}
 }
 
-func (c *PowerCache) EvictionCount() int64 {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	return c.statEvictions
+// record counts a request for the key and whether it hit, per key as well if
+// TrackKeyStats is set. The caller must hold the lock.
+func (c *PowerCache) record(key string, hit bool) {
+	atomic.AddInt64(&c.statReqs, 1)
+	if hit {
+		atomic.AddInt64(&c.statHits, 1)
+	}
+	if c.HitRateWindow > 0 {
+		c.recordWindow(hit)
+	}
+	if c.TrackKeyStats {
+		ks, ok := c.keyStats[key]
+		if !ok {
+			ks = &KeyStat{Key: key}
+			c.keyStats[key] = ks
+		}
+		if hit {
+			ks.Hits++
+		} else {
+			ks.Misses++
+		}
+	}
+}
+
+// recordWindow keeps the outcome of the last HitRateWindow requests in a
+// ring, oldest first out. The caller must hold the lock.
+func (c *PowerCache) recordWindow(hit bool) {
+	if cap(c.window) != c.HitRateWindow {
+		//The window was resized, start it over
+		c.window, c.windowNext, c.windowHits = make([]bool, 0, c.HitRateWindow), 0, 0
+	}
+	if len(c.window) < cap(c.window) {
+		c.window = append(c.window, hit)
+	} else {
+		if c.window[c.windowNext] {
+			c.windowHits--
+		}
+		c.window[c.windowNext] = hit
+		c.windowNext = (c.windowNext + 1) % len(c.window)
+	}
+	if hit {
+		c.windowHits++
+	}
+}
+
+// RecentHitRate is the hit rate of the last HitRateWindow requests, which
+// shows how the cache is doing now rather than since the last ResetStats
+func (c *PowerCache) RecentHitRate() float64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.window) == 0 {
+		return 0.0
+	}
+	return float64(c.windowHits) / float64(len(c.window))
+}
+
+// TopKeys returns the n keys requested most often, with their hits and
+// misses, once TrackKeyStats is set. Keys stay counted after they leave the
+// cache so keys that keep missing show up too, until ResetStats.
+func (c *PowerCache) TopKeys(n int) []KeyStat {
+	c.mu.RLock()
+	stats := make([]KeyStat, 0, len(c.keyStats))
+	for _, ks := range c.keyStats {
+		stats = append(stats, *ks)
+	}
+	c.mu.RUnlock()
+	sort.Slice(stats, func(i, j int) bool {
+		ri, rj := stats[i].Hits+stats[i].Misses, stats[j].Hits+stats[j].Misses
+		if ri != rj {
+			return ri > rj
+		}
+		return stats[i].Key < stats[j].Key
+	})
+	if n < len(stats) {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+// Touch resets the access expiry of the key as if it had been read, without
+// copying out the value or counting as a request, and returns whether the
+// key was there. The write expiry is left alone, SetExpiresIn moves that. An
+// expired entry found along the way is removed as Expired.
+func (c *PowerCache) Touch(key string) bool {
+	key = c.normalize(key)
+	c.ensureInitialized()
+	now := time.Now()
+	c.mu.Lock()
+	var removed []removal
+	_, ok := c.values[key]
+	if ok && c.isExpired(key, now) {
+		removed = c.expire(key, removed)
+		ok = false
+	}
+	if ok {
+		c.touch(key, now)
+	}
+	c.mu.Unlock()
+	c.notify(removed)
+	return ok
+}
+
+// touch records a read of a present key, every read path goes through here
+// so the admission filter and eviction order see the same accesses. The caller
+// must hold the lock.
+func (c *PowerCache) touch(key string, now time.Time) {
+	if c.sketch != nil {
+		c.sketch.increment(key)
+	}
+	c.atime[key] = now
+	c.rtime[key] = now
+	c.evict.track(key)
+}
+
+// clone hands out a copy of a value when there is a CloneFunc, so callers
+// can't mutate what's cached
+func (c *PowerCache) clone(value interface{}) interface{} {
+	if c.CloneFunc == nil {
+		return value
+	}
+	return c.CloneFunc(value)
+}
+
+// encode is how a value is stored: our own copy, so the caller can't change
+// it after the fact, put through the Encoder if there is one. The Weigher and
+// Sizer see the encoded value. Typed caches keep their values themselves.
+func (c *PowerCache) encode(value interface{}) interface{} {
+	if c.store != nil {
+		return value
+	}
+	value = c.clone(value)
+	if c.Encoder != nil {
+		value = c.Encoder(value)
+	}
+	return value
+}
+
+// decode undoes encode for a value on its way out
+func (c *PowerCache) decode(value interface{}) interface{} {
+	if c.store != nil {
+		return value
+	}
+	if c.Decoder != nil {
+		value = c.Decoder(value)
+	}
+	return c.clone(value)
+}
+
+// GetWithTTL is GetIfPresent but also returns how long the entry has left
+// before it expires, or NoExpiration if the cache has no expiry policy.
+func (c *PowerCache) GetWithTTL(key string) (interface{}, time.Duration, error) {
+	return c.getIfPresent(key, true)
+}
+
+// ExpiresAt returns the absolute time the key will expire and whether it's
+// present, without touching it or counting a request. The time is zero when
+// the cache has no expiry policy.
+func (c *PowerCache) ExpiresAt(key string) (time.Time, bool) {
+	key = c.normalize(key)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if _, ok := c.values[key]; !ok || c.isExpired(key, time.Now()) {
+		return time.Time{}, false
+	}
+	d, _ := c.deadlineOf(key)
+	return d, true
+}
+
+// CachedAt returns when the key's value was written, such as for a
+// Last-Modified header, and whether it's present. Reads don't move it, and
+// neither do deadlines set with SetExpiresIn, only a new value does.
+func (c *PowerCache) CachedAt(key string) (time.Time, bool) {
+	key = c.normalize(key)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if _, ok := c.values[key]; !ok || c.isExpired(key, time.Now()) {
+		return time.Time{}, false
+	}
+	return c.wtime[key], true
+}
+
+// GetAllWithTTL is GetWithTTL for many keys under a single lock. Only keys
+// that are present and unexpired are in the result, expired ones are evicted
+// on the way.
+func (c *PowerCache) GetAllWithTTL(keys []string) map[string]TTLValue {
+	c.ensureInitialized()
+	found := make(map[string]TTLValue)
+	now := time.Now()
+	c.mu.Lock()
+	var removed []removal
+	for _, key := range keys {
+		//Results are keyed the way they were asked for
+		k := c.normalize(key)
+		v, ok := c.values[k]
+		if ok && c.isExpired(k, now) {
+			removed = c.expire(k, removed)
+			ok = false
+		}
+		c.record(k, ok)
+		if !ok {
+			continue
+		}
+		c.touch(k, now)
+		found[key] = TTLValue{c.decode(v), c.ttlOf(k, now)}
+	}
+	c.mu.Unlock()
+	c.notify(removed)
+	return found
+}
+
+// ttlOf expects the caller to hold the lock
+func (c *PowerCache) ttlOf(key string, now time.Time) time.Duration {
+	d, ok := c.deadlineOf(key)
+	if !ok {
+		return NoExpiration
+	}
+	return d.Sub(now)
+}
+
+func (c *PowerCache) Get(key string) (interface{}, error) {
+	return c.GetWithValueLoader(key, c.ValueLoader)
+}
+
+// GetWithValueLoader returns the cached value, loading it with valueLoader
+// on a miss. With ServeStaleOnError an expired entry is reloaded in place, and
+// if the load fails with anything but ErrNotFound its old value is returned
+// instead of the error. It stays cached, expired, until a reload succeeds or
+// it's swept out like any other expired entry.
+func (c *PowerCache) GetWithValueLoader(key string, valueLoader ValueLoader) (interface{}, error) {
+	v, _, err := c.get(c.normalize(key), valueLoader)
+	return v, err
+}
+
+// GetWithFreshness is Get that also reports whether the value is fresh,
+// rather than an expired one handed out by StaleWhileRevalidate while another
+// caller reloads it or by ServeStaleOnError because the reload failed. It is
+// only fresh with a nil error.
+func (c *PowerCache) GetWithFreshness(key string) (interface{}, bool, error) {
+	return c.get(c.normalize(key), c.ValueLoader)
+}
+
+// get is GetWithValueLoader for a normalized key, along with whether the
+// value is fresh
+func (c *PowerCache) get(key string, valueLoader ValueLoader) (interface{}, bool, error) {
+	if c.StaleWhileRevalidate {
+		if v, stale, reload := c.serveStale(key); stale {
+			return v, false, nil
+		} else if reload {
+			return c.revalidate(key, valueLoader)
+		}
+	}
+	if c.ServeStaleOnError {
+		if old, ok := c.expiredValue(key); ok {
+			return c.reloadOrStale(key, valueLoader, old)
+		}
+	}
+	v, err := c.GetIfPresent(key)
+	//Anything but a plain miss came from the cache, even a remembered error
+	if err != ErrNotPresent {
+		return v, err == nil, err
+	}
+	v, err = c.loadWithValueLoader(key, valueLoader)
+	return v, err == nil, err
+}
+
+// GetBatch is Get for many keys at once. Cached keys are read straight away
+// and the rest loaded with the ValueLoader, maxConcurrency at a time, so cold
+// keys don't wait on each other. A key asked for more than once (or under
+// names the KeyNormalizer maps together) is only loaded once. It returns the
+// value of every key that was found or loaded and the error of every one that
+// wasn't.
+func (c *PowerCache) GetBatch(keys []string, maxConcurrency int) (map[string]interface{}, map[string]error) {
+	//Results are gathered per normalized key, then handed out to every name
+	//the key was asked for under
+	found := make(map[string]interface{})
+	failed := make(map[string]error)
+	asked := make(map[string][]string)
+	var missing []string
+	for _, k := range keys {
+		nk := c.normalize(k)
+		if _, ok := asked[nk]; !ok {
+			v, err := c.GetIfPresent(nk)
+			switch {
+			case err == nil:
+				found[nk] = v
+			case err != ErrNotPresent:
+				failed[nk] = err
+			default:
+				missing = append(missing, nk)
+			}
+		}
+		asked[nk] = append(asked[nk], k)
+	}
+	var mu sync.Mutex
+	c.loadAll(missing, maxConcurrency, func(key string, value interface{}, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			failed[key] = err
+		} else {
+			found[key] = value
+		}
+	})
+	values := make(map[string]interface{})
+	errs := make(map[string]error)
+	for nk, names := range asked {
+		for _, k := range names {
+			if err, ok := failed[nk]; ok {
+				errs[k] = err
+			} else {
+				values[k] = found[nk]
+			}
+		}
+	}
+	return values, errs
+}
+
+// GetWithResult is Get that also reports whether this call ran the
+// ValueLoader, whether or not the load succeeded, rather than being answered
+// from the cache
+func (c *PowerCache) GetWithResult(key string) (interface{}, bool, error) {
+	key = c.normalize(key)
+	v, err := c.GetIfPresent(key)
+	if err != ErrNotPresent {
+		return v, false, err
+	}
+	v, err = c.loadWithValueLoader(key, c.ValueLoader)
+	return v, c.ValueLoader != nil, err
+}
+
+// GetMaxStale is Get for a caller that can only use a value written within
+// maxStale. An older value is treated as a miss and loaded again with the
+// ValueLoader there and then, whatever its TTL says.
+func (c *PowerCache) GetMaxStale(key string, maxStale time.Duration) (interface{}, error) {
+	key = c.normalize(key)
+	c.ensureInitialized()
+	now := time.Now()
+	c.mu.Lock()
+	if _, ok := c.values[key]; ok && now.Sub(c.wtime[key]) > maxStale {
+		c.record(key, false)
+		c.mu.Unlock()
+		return c.loadWithValueLoader(key, c.ValueLoader)
+	}
+	_, removed, err := c.lookup(key, true, now)
+	v := c.values[key]
+	c.mu.Unlock()
+	c.notify(removed)
+	if err == ErrNotPresent {
+		return c.loadWithValueLoader(key, c.ValueLoader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.decode(v), nil
+}
+
+// serveStale checks for an expired entry a loader is already reloading,
+// returning its old value if there is one. Otherwise the first caller to find
+// the entry expired is told to reload it. Neither applies to entries that
+// haven't expired or aren't there at all.
+func (c *PowerCache) serveStale(key string) (interface{}, bool, bool) {
+	c.ensureInitialized()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.values[key]
+	if !ok || !c.isExpired(key, time.Now()) {
+		return nil, false, false
+	}
+	if c.revalidating[key] {
+		c.record(key, true)
+		return c.decode(v), true, false
+	}
+	c.revalidating[key] = true
+	c.record(key, false)
+	return nil, false, true
+}
+
+// revalidate reloads an expired entry while serveStale hands its old value
+// to everyone else. If the load fails the stale value is dropped rather than
+// served forever, unless ServeStaleOnError says to keep serving it.
+func (c *PowerCache) revalidate(key string, valueLoader ValueLoader) (interface{}, bool, error) {
+	v, err := c.loadWithValueLoader(key, valueLoader)
+	fresh := err == nil
+	c.mu.Lock()
+	delete(c.revalidating, key)
+	var removed []removal
+	if err != nil && c.isExpired(key, time.Now()) {
+		old, ok := c.values[key]
+		if ok && c.ServeStaleOnError && !errors.Is(err, ErrNotFound) {
+			v, err = c.decode(old), nil
+		} else {
+			removed = c.discard(key, Expired, removed)
+		}
+	}
+	c.mu.Unlock()
+	c.notify(removed)
+	return v, fresh, err
+}
+
+// expiredValue returns the old value of an expired entry, counting the read
+// as a miss, for ServeStaleOnError to fall back on
+func (c *PowerCache) expiredValue(key string) (interface{}, bool) {
+	c.ensureInitialized()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.values[key]
+	if !ok || !c.isExpired(key, time.Now()) {
+		return nil, false
+	}
+	c.record(key, false)
+	return c.decode(v), true
+}
+
+// reloadOrStale loads the key, returning old if the load fails. ErrNotFound
+// means the key is gone rather than the loader being down, so the expired
+// entry is dropped and the error returned.
+func (c *PowerCache) reloadOrStale(key string, valueLoader ValueLoader, old interface{}) (interface{}, bool, error) {
+	v, err := c.loadWithValueLoader(key, valueLoader)
+	if err == nil {
+		return v, true, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return old, false, nil
+	}
+	c.mu.Lock()
+	var removed []removal
+	if _, ok := c.values[key]; ok && c.isExpired(key, time.Now()) {
+		removed = c.discard(key, Expired, removed)
+	}
+	c.mu.Unlock()
+	c.notify(removed)
+	return nil, false, err
+}
+
+// GetOrLoad returns the cached value, or loads it with loader if there is
+// none. Only a successful load is cached: an error is returned as is and
+// leaves nothing behind, not even for NegativeTTL or ErrorTTL, so the next
+// call loads again. A remembered ErrNotFound or load error from another path
+// counts as a miss. A nil value with a nil error is a real (cached) nil.
+func (c *PowerCache) GetOrLoad(key string, loader ValueLoader) (interface{}, error) {
+	key = c.normalize(key)
+	if v, err := c.GetIfPresent(key); err == nil {
+		return v, nil
+	}
+	return c.load(key, loader, false)
+}
+
+// hasExpiry reports whether any time based expiry policy is configured.
+// PerKeyExpiry counts as one, even though only keys given a deadline with
+// SetExpiresAt, SetExpiresIn or PutWithTTL expire under it.
+func (c *PowerCache) hasExpiry() bool {
+	return c.PerKeyExpiry ||
+		c.ExpiresAfterWriteDuration != emptyDuration ||
+		c.ExpiresAfterAccessDuration != emptyDuration ||
+		c.MaxAge != emptyDuration ||
+		c.MaxIdle != emptyDuration
+}
+
+// deadlineOf works out when a key expires under every configured policy, the
+// earliest one wins. An explicit deadline from SetExpiresAt/SetExpiresIn takes
+// the place of the write deadline. The caller must hold the lock.
+func (c *PowerCache) deadlineOf(key string) (time.Time, bool) {
+	if !c.hasExpiry() || c.pinned[key] {
+		return time.Time{}, false
+	}
+	var d time.Time
+	found := false
+	earliest := func(t time.Time) {
+		if !found || t.Before(d) {
+			d = t
+			found = true
+		}
+	}
+	if e, ok := c.deadline[key]; ok {
+		earliest(e)
+	} else if c.ExpiresAfterWriteDuration != emptyDuration {
+		earliest(c.wtime[key].Add(c.ExpiresAfterWriteDuration))
+	}
+	if c.ExpiresAfterAccessDuration != emptyDuration {
+		earliest(c.atime[key].Add(c.ExpiresAfterAccessDuration))
+	}
+	//MaxAge is measured from the write regardless of any accesses
+	if c.MaxAge != emptyDuration {
+		earliest(c.wtime[key].Add(c.MaxAge))
+	}
+	//MaxIdle is measured from the last read, writes don't keep a key alive
+	if c.MaxIdle != emptyDuration {
+		earliest(c.rtime[key].Add(c.MaxIdle))
+	}
+	return d, found
+}
+
+// isExpired expects the caller to hold the lock
+func (c *PowerCache) isExpired(key string, now time.Time) bool {
+	d, ok := c.deadlineOf(key)
+	return ok && d.Before(now)
+}
+
+// remove deletes the key from every map, the caller must hold the lock
+func (c *PowerCache) remove(key string) {
+	if _, ok := c.values[key]; ok {
+		c.totalWeight -= c.weight[key]
+		c.cacheSizeEst -= c.size[key]
+	}
+	c.evict.untrack(key)
+	delete(c.values, key)
+	delete(c.wtime, key)
+	delete(c.atime, key)
+	delete(c.rtime, key)
+	delete(c.deadline, key)
+	delete(c.negative, key)
+	delete(c.failed, key)
+	delete(c.weight, key)
+	delete(c.meta, key)
+	delete(c.version, key)
+	delete(c.pinned, key)
+	delete(c.size, key)
+	if c.store != nil {
+		c.store.drop(key)
+	}
+}
+
+// measure records the value's size from the Sizer, replacing whatever the old
+// value counted towards MaxSize. The caller must hold the lock.
+func (c *PowerCache) measure(key string, value interface{}) {
+	if c.Sizer == nil {
+		return
+	}
+	n := c.Sizer(key, value)
+	c.cacheSizeEst += n - c.size[key]
+	c.size[key] = n
+}
+
+// discard removes a present key and counts it as an eviction. If there is a
+// RemovalListener the entry is appended to removed so the caller can notify
+// once it has released the lock.
+func (c *PowerCache) discard(key string, cause RemovalCause, removed []removal) []removal {
+	if _, ok := c.values[key]; !ok {
+		return removed
+	}
+	if c.RemovalListener != nil {
+		removed = append(removed, removal{key, c.valueOf(key), cause})
+	}
+	c.remove(key)
+	atomic.AddInt64(&c.statEvictions, 1)
+	atomic.AddInt64(&c.statCauses[cause], 1)
+	return removed
+}
+
+// expire discards an expired entry, unless StaleWhileRevalidate is reloading
+// it. That entry is still handed to everyone else while the reload runs, so
+// it stays until revalidate is done with it, and callers treat it as missing
+// in the meantime. The caller must hold the lock.
+func (c *PowerCache) expire(key string, removed []removal) []removal {
+	if c.revalidating[key] {
+		return removed
+	}
+	return c.discard(key, Expired, removed)
+}
+
+// notify must be called without holding the lock so listeners can use the cache
+func (c *PowerCache) notify(removed []removal) {
+	for _, r := range removed {
+		c.RemovalListener(r.key, r.value, r.cause)
+	}
+}
+
+func (c *PowerCache) Invalidate(key string) {
+	key = c.normalize(key)
+	c.mu.Lock()
+	removed := c.discard(key, Explicit, nil)
+	c.mu.Unlock()
+	c.notify(removed)
+}
+
+// InvalidateMatching removes every entry whose key pred returns true for,
+// with cause Explicit, and returns how many it removed. pred is called
+// without the lock held, on a copy of the keys taken up front.
+func (c *PowerCache) InvalidateMatching(pred func(key string) bool) int {
+	var matched []string
+	for _, k := range c.keys() {
+		if pred(k) {
+			matched = append(matched, k)
+		}
+	}
+	c.mu.Lock()
+	var removed []removal
+	count := 0
+	for _, k := range matched {
+		if _, ok := c.values[k]; ok {
+			removed = c.discard(k, Explicit, removed)
+			count++
+		}
+	}
+	c.mu.Unlock()
+	c.notify(removed)
+	return count
+}
+
+// InvalidateExpired removes only the entries that are past their deadline,
+// leaving live entries alone even if the cache is at its limits. It returns
+// how many entries were removed.
+func (c *PowerCache) InvalidateExpired() int {
+	expired, _ := c.expiredKeys(0)
+	c.mu.Lock()
+	removed, count := c.sweepExpired(expired, time.Now(), 0, nil)
+	c.mu.Unlock()
+	c.notify(removed)
+	return count
+}
+
+// expiredKeys checks at most limit entries for expiry, or all of them if
+// limit is 0. Map iteration order is random so a limited sweep samples a
+// different part of the cache each time. The scan only takes the read lock,
+// so reads carry on while it runs, and the keys are only candidates for
+// sweepExpired to check again. It also returns how many entries it looked at.
+func (c *PowerCache) expiredKeys(limit int) ([]string, int) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.hasExpiry() {
+		return nil, 0
+	}
+	now := time.Now()
+	var expired []string
+	scanned := 0
+	for k, _ := range c.values {
+		if limit != 0 && scanned >= limit {
+			break
+		}
+		scanned++
+		if c.isExpired(k, now) {
+			expired = append(expired, k)
+		}
+	}
+	return expired, scanned
+}
+
+// sweepExpired discards the keys found by expiredKeys that are still expired,
+// skipping any written or touched since, and prunes lapsed negative entries.
+// The caller must hold the lock.
+func (c *PowerCache) sweepExpired(expired []string, now time.Time, limit int, removed []removal) ([]removal, int) {
+	count := 0
+	for _, k := range expired {
+		if _, ok := c.values[k]; ok && c.isExpired(k, now) && !c.revalidating[k] {
+			removed = c.discard(k, Expired, removed)
+			count++
+		}
+	}
+	c.pruneNegative(now, limit)
+	return removed, count
+}
+
+// pruneNegative drops negative entries and failed loads whose ttl has passed,
+// looking at no more than limit of each if it isn't 0. The caller must hold
+// the lock.
+func (c *PowerCache) pruneNegative(now time.Time, limit int) {
+	scanned := 0
+	for k, n := range c.negative {
+		if limit != 0 && scanned >= limit {
+			break
+		}
+		scanned++
+		if n.Before(now) {
+			delete(c.negative, k)
+		}
+	}
+	scanned = 0
+	for k, f := range c.failed {
+		if limit != 0 && scanned >= limit {
+			break
+		}
+		scanned++
+		if f.until.Before(now) {
+			delete(c.failed, k)
+		}
+	}
+}
+
+// InvalidateAll drops every entry, telling the RemovalListener about each of
+// them with cause Explicit once the lock has been released. Each entry counts
+// as an explicit eviction, use Clear to flush without that.
+func (c *PowerCache) InvalidateAll() {
+	c.dropAll(true)
+}
+
+// InvalidateAllExcept is InvalidateAll for every key keep returns false for,
+// counting and reporting only those, and returns how many it removed. Like
+// InvalidateMatching, keep is called without the lock on the keys there were
+// when it started, so anything put while it runs is kept too.
+func (c *PowerCache) InvalidateAllExcept(keep func(key string) bool) int {
+	return c.InvalidateMatching(func(key string) bool {
+		return !keep(key)
+	})
+}
+
+// Clear is InvalidateAll without counting the entries as evictions, so a
+// flush doesn't show up in EvictionCount. The RemovalListener is still told
+// about every entry.
+func (c *PowerCache) Clear() {
+	c.dropAll(false)
+}
+
+func (c *PowerCache) dropAll(count bool) {
+	c.ensureInitialized()
+	c.mu.Lock()
+	var removed []removal
+	if c.RemovalListener != nil {
+		removed = make([]removal, 0, len(c.values))
+		for k := range c.values {
+			removed = append(removed, removal{k, c.valueOf(k), Explicit})
+		}
+	}
+	defer c.notify(removed)
+	defer c.mu.Unlock()
+	if count {
+		atomic.AddInt64(&c.statEvictions, int64(len(c.values)))
+		atomic.AddInt64(&c.statCauses[Explicit], int64(len(c.values)))
+	}
+	c.values = make(map[string]interface{})
+	c.wtime = make(map[string]time.Time)
+	c.atime = make(map[string]time.Time)
+	c.rtime = make(map[string]time.Time)
+	c.deadline = make(map[string]time.Time)
+	c.negative = make(map[string]time.Time)
+	c.failed = make(map[string]failedLoad)
+	c.weight = make(map[string]int64)
+	c.meta = make(map[string]interface{})
+	c.version = make(map[string]uint64)
+	c.pinned = make(map[string]bool)
+	c.size = make(map[string]int64)
+	c.totalWeight = 0
+	c.cacheSizeEst = 0
+	if c.store != nil {
+		c.store.dropAll()
+	}
+	c.evict = evictionHeap{c: c, index: make(map[string]int), priority: make(map[string]float64)}
+}
+
+// CleanUp evicts entries in two passes
+//   - Time Based Eviction: every key past its deadline is evicted
+//   - Size Based Eviction: while the cache is at or over MaxKeys, MaxSize or
+//     MaxWeight the key with the lowest priority is evicted, keys are
+//     prioritized on their weight and how recently they were used
+//
+// Looking for expired keys only takes the read lock, and a key that was
+// written or read again by the time it would be evicted is kept.
+func (c *PowerCache) CleanUp() {
+	//MaxCleanUpScan bounds how long we hold the lock on huge caches
+	c.cleanUp(c.MaxCleanUpScan, false)
+}
+
+// ForceCleanUp is CleanUp without MaxCleanUpScan, every entry is checked for
+// expiry no matter how big the cache is. Like CleanUp it can be called at any
+// time, and the next periodic maintenance is scheduled from when it ran.
+func (c *PowerCache) ForceCleanUp() {
+	c.cleanUp(0, false)
+}
+
+// Shrink is for dropping entries under memory pressure, wired up to
+// whatever watches memory, such as a goroutine polling runtime.ReadMemStats.
+// Every expired entry is swept like ForceCleanUp, then the lowest priority
+// entries are evicted with cause Size until fraction of what was left is gone.
+// It returns how many entries were removed.
+func (c *PowerCache) Shrink(fraction float64) int {
+	expired, _ := c.expiredKeys(0)
+	c.mu.Lock()
+	removed, count := c.sweepExpired(expired, time.Now(), 0, nil)
+	if fraction > 1 {
+		fraction = 1
+	}
+	for target := int(float64(len(c.values)) * fraction); target > 0; target-- {
+		victim, ok := c.findVictim()
+		if !ok {
+			break
+		}
+		c.evict.raiseFloor(victim)
+		removed = c.discard(victim, Size, removed)
+		count++
+	}
+	c.mu.Unlock()
+	c.notify(removed)
+	return count
+}
+
+// cleanUp sweeps at most limit entries for expiry, or all of them if limit
+// is 0, then evicts back down to the limits. background is set when it was
+// started by cleanUpInBackground.
+func (c *PowerCache) cleanUp(limit int, background bool) {
+	expired, scanned := c.expiredKeys(limit)
+	c.mu.Lock()
+	removed, count := c.sweepExpired(expired, time.Now(), limit, nil)
+	//The heap hands over each victim without a scan, so evicting stays under
+	//the one lock
+	removed = c.evictOverLimits(removed)
+
+	//Now set the time for the next cleaning
+	if c.PeriodicMaintenance != emptyDuration {
+		c.nextClean = time.Now().Add(c.adaptMaintenance(count, scanned))
+	}
+	if background {
+		c.cleaning = false
+	}
+	c.mu.Unlock()
+	c.notify(removed)
+}
+
+// adaptMaintenance returns the time until the next periodic maintenance.
+// With MinMaintenance or MaxMaintenance set the interval halves whenever a
+// quarter or more of the entries looked at had expired, and doubles when
+// fewer than 1 in 20 had, never going past either bound. A bound that isn't
+// set is PeriodicMaintenance itself. The caller must hold the lock.
+func (c *PowerCache) adaptMaintenance(expired, scanned int) time.Duration {
+	if c.maintenance == emptyDuration {
+		c.maintenance = c.PeriodicMaintenance
+	}
+	if c.MinMaintenance == emptyDuration && c.MaxMaintenance == emptyDuration {
+		return c.PeriodicMaintenance
+	}
+	min, max := c.MinMaintenance, c.MaxMaintenance
+	if min == emptyDuration {
+		min = c.PeriodicMaintenance
+	}
+	if max == emptyDuration {
+		max = c.PeriodicMaintenance
+	}
+	switch {
+	case scanned > 0 && expired*4 >= scanned:
+		c.maintenance /= 2
+	case expired*20 < scanned:
+		c.maintenance *= 2
+	}
+	if c.maintenance < min {
+		c.maintenance = min
+	}
+	if c.maintenance > max {
+		c.maintenance = max
+	}
+	return c.maintenance
+}
+
+// evictOverLimits keeps evicting our worst guy until we are back under the
+// limits. With EvictBatchSize set, once it has to evict at all it evicts at
+// least that many, leaving headroom so the next few puts don't each have to
+// evict one. The caller must hold the lock.
+func (c *PowerCache) evictOverLimits(removed []removal) []removal {
+	evicted := 0
+	for c.overLimits() || (evicted > 0 && evicted < c.EvictBatchSize) {
+		victim, ok := c.findVictim()
+		if !ok {
+			break
+		}
+		c.evict.raiseFloor(victim)
+		removed = c.discard(victim, Size, removed)
+		evicted++
+	}
+	return removed
+}
+
+// overLimits expects the caller to hold the lock
+func (c *PowerCache) overLimits() bool {
+	if c.MaxKeys != 0 && len(c.values) >= c.MaxKeys {
+		return true
+	}
+	if c.MaxSize != 0 && c.cacheSizeEst >= c.MaxSize {
+		return true
+	}
+	if c.MaxWeight != 0 && c.totalWeight >= c.MaxWeight {
+		return true
+	}
+	return false
+}
+
+// findVictim returns the key that should be evicted first, which the
+// eviction heap keeps at the top. With EvictionSampleSize set it is the worst
+// of that many keys taken from the map instead. A Comparer works on ages that
+// keep changing, so it needs a full scan to be right. The caller must hold the
+// lock.
+func (c *PowerCache) findVictim() (string, bool) {
+	if c.EvictionSampleSize > 0 {
+		return c.sampleVictim()
+	}
+	if c.Comparer != nil {
+		return c.scanVictim()
+	}
+	if c.evict.Len() == 0 {
+		return "", false
+	}
+	return c.evict.keys[0], true
+}
+
+// scanVictim compares every unpinned key at the same instant
+func (c *PowerCache) scanVictim() (string, bool) {
+	now := time.Now()
+	var victim string
+	found := false
+	for k := range c.values {
+		if c.pinned[k] {
+			continue
+		}
+		if !found || c.evictsBefore(k, victim, now) {
+			victim = k
+			found = true
+		}
+	}
+	return victim, found
+}
+
+// sampleVictim relies on map iteration starting somewhere random each time,
+// so every sample comes from a fresh range over the map
+func (c *PowerCache) sampleVictim() (string, bool) {
+	now := time.Now()
+	var victim string
+	found := false
+	for i := 0; i < c.EvictionSampleSize; i++ {
+		for k, _ := range c.values {
+			if c.pinned[k] {
+				continue
+			}
+			if !found || c.evictsBefore(k, victim, now) {
+				victim = k
+				found = true
+			}
+			break
+		}
+	}
+	return victim, found
+}
+
+// tstampOf is the time a key is scored on, expiring caches compare deadlines
+// and others compare last access. The caller must hold the lock.
+func (c *PowerCache) tstampOf(key string) time.Time {
+	if d, ok := c.deadlineOf(key); ok {
+		return d
+	}
+	return c.atime[key]
+}
+
+// evictsBefore reports whether a should be evicted ahead of b. Keys are
+// ordered by the priority they were given when last tracked and then by how
+// old they are, so the order never changes just because time has passed. A
+// custom Comparer instead sees the weights and ages as of now. Keys that are
+// still tied go by the lowest hash, so the same entries always evict in the
+// same order however the map happens to iterate, and the victims are spread
+// over the key space. The caller must hold the lock.
+func (c *PowerCache) evictsBefore(a, b string, now time.Time) bool {
+	aTstamp := c.tstampOf(a)
+	bTstamp := c.tstampOf(b)
+
+	//A custom comparer sees ages where bigger always means a better victim
+	if c.Comparer != nil {
+		if r := c.Comparer(c.weight[a], c.weight[b], now.Sub(aTstamp), now.Sub(bTstamp)); r != 0 {
+			return r < 0
+		}
+	} else {
+		if pa, pb := c.evict.priority[a], c.evict.priority[b]; pa != pb {
+			return pa < pb
+		}
+		if !aTstamp.Equal(bTstamp) {
+			return aTstamp.Before(bTstamp)
+		}
+	}
+	//Only hash on a tie
+	ha, hb := keyHash(a), keyHash(b)
+	if ha != hb {
+		return ha < hb
+	}
+	return a < b
+}
+
+// SetExpiresAfterWrite changes ExpiresAfterWriteDuration while the cache is
+// in use, 0 turns write expiry off. Deadlines are worked out from when each
+// entry was written, so existing entries are held to the new duration straight
+// away and the next CleanUp sweeps any it has expired.
+func (c *PowerCache) SetExpiresAfterWrite(d time.Duration) {
+	c.ensureInitialized()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ExpiresAfterWriteDuration = d
+	c.reorder()
+}
+
+// SetExpiresAfterAccess is SetExpiresAfterWrite for
+// ExpiresAfterAccessDuration
+func (c *PowerCache) SetExpiresAfterAccess(d time.Duration) {
+	c.ensureInitialized()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ExpiresAfterAccessDuration = d
+	c.reorder()
+}
+
+// reorder rebuilds the eviction heap after a change that moves every
+// deadline at once. The caller must hold the lock.
+func (c *PowerCache) reorder() {
+	c.evict.now = time.Now()
+	heap.Init(&c.evict)
+}
+
+// SetExpiresAt overrides the write expiry of a key. It returns ErrNoExpiry if
+// the cache has no expiry policy, since the deadline would never be checked,
+// and ErrExpiresInPast if expires has already passed. Set PerKeyExpiry to
+// use deadlines on a cache without a TTL of its own.
+func (c *PowerCache) SetExpiresAt(key string, expires time.Time) error {
+	key = c.normalize(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.hasExpiry() {
+		return ErrNoExpiry
+	}
+	if !expires.After(time.Now()) {
+		return ErrExpiresInPast
+	}
+	//Deadlines are only kept for present keys so they can't leak
+	if _, ok := c.values[key]; ok {
+		c.deadline[key] = expires
+		c.evict.track(key)
+	}
+	return nil
+}
+
+// SetExpiresIn is SetExpiresAt relative to now and returns the same errors
+func (c *PowerCache) SetExpiresIn(key string, expiresIn time.Duration) error {
+	return c.SetExpiresAt(key, time.Now().Add(expiresIn))
+}
+
+// Pin keeps a present key from ever expiring or being evicted to make room.
+// It can still be replaced with Put or removed with Invalidate, which also
+// drops the pin.
+func (c *PowerCache) Pin(key string) {
+	key = c.normalize(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.values[key]; ok {
+		c.pinned[key] = true
+		c.evict.untrack(key)
+	}
+}
+
+// Unpin lets the key expire and be evicted again as if it had never been
+// pinned, so a key pinned past its deadline expires straight away.
+func (c *PowerCache) Unpin(key string) {
+	key = c.normalize(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pinned[key] {
+		delete(c.pinned, key)
+		c.evict.track(key)
+	}
+}
+
+// WeightOf returns the key's weight and whether it's present
+func (c *PowerCache) WeightOf(key string) (int64, bool) {
+	key = c.normalize(key)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if _, ok := c.values[key]; !ok {
+		return 0, false
+	}
+	return c.weight[key], true
+}
+
+// SetWeight returns ErrWeightTooLarge and leaves the weight alone if weight
+// alone would exceed MaxWeight or MaxEntryWeight.
+func (c *PowerCache) SetWeight(key string, weight int64) error {
+	key = c.normalize(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if (c.MaxWeight != 0 && weight > c.MaxWeight) || c.tooHeavy(weight) {
+		return ErrWeightTooLarge
+	}
+	//Weights are only kept for present keys so they can't leak
+	if _, ok := c.values[key]; ok {
+		c.totalWeight += weight - c.weight[key]
+		c.weight[key] = weight
+		c.evict.track(key)
+	}
+	return nil
+}
+
+// SetWeights is SetWeight for many keys under a single lock, for reweighting
+// in bulk. Missing keys are skipped. If any weight is too large it returns
+// ErrWeightTooLarge without changing any of them.
+func (c *PowerCache) SetWeights(weights map[string]int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, w := range weights {
+		if (c.MaxWeight != 0 && w > c.MaxWeight) || c.tooHeavy(w) {
+			return ErrWeightTooLarge
+		}
+	}
+	var delta int64
+	for k, w := range weights {
+		key := c.normalize(k)
+		if _, ok := c.values[key]; ok {
+			delta += w - c.weight[key]
+			c.weight[key] = w
+			c.evict.track(key)
+		}
+	}
+	c.totalWeight += delta
+	return nil
+}
+
+func (c *PowerCache) Stats() Stats {
+	hits, reqs := c.requestStats()
+	s := Stats{
+		Hits:               hits,
+		Misses:             reqs - hits,
+		Requests:           reqs,
+		HitRate:            c.HitRate(),
+		AverageLoadPenalty: c.AverageLoadPenalty(),
+		Evictions:          atomic.LoadInt64(&c.statEvictions),
+		ExplicitEvictions:  atomic.LoadInt64(&c.statCauses[Explicit]),
+		ExpiredEvictions:   atomic.LoadInt64(&c.statCauses[Expired]),
+		SizeEvictions:      atomic.LoadInt64(&c.statCauses[Size]),
+		LoadSuccesses:      atomic.LoadInt64(&c.statLoadCount),
+		LoadFailures:       atomic.LoadInt64(&c.statLoadFailCount),
+	}
+	return s
+}
+
+// requestStats reads the hit and request counters, which are updated
+// atomically outside the lock. Hits are read first so they can never
+// outnumber the requests.
+func (c *PowerCache) requestStats() (int64, int64) {
+	hits := atomic.LoadInt64(&c.statHits)
+	reqs := atomic.LoadInt64(&c.statReqs)
+	return hits, reqs
+}
+
+func (c *PowerCache) HitRate() float64 {
+	hits, reqs := c.requestStats()
+	if reqs == 0 {
+		return 0.0
+	}
+	return float64(hits) / float64(reqs)
+}
+
+func (c *PowerCache) MissRate() float64 {
+	hits, reqs := c.requestStats()
+	if reqs == 0 {
+		return 0.0
+	}
+	return float64(reqs-hits) / float64(reqs)
+}
+
+func (c *PowerCache) HitCount() int64 {
+	hits, _ := c.requestStats()
+	return hits
+}
+
+func (c *PowerCache) MissCount() int64 {
+	hits, reqs := c.requestStats()
+	return reqs - hits
+}
+
+func (c *PowerCache) RequestCount() int64 {
+	_, reqs := c.requestStats()
+	return reqs
+}
+
+func (c *PowerCache) AverageLoadPenalty() time.Duration {
+	count := atomic.LoadInt64(&c.statLoadCount)
+	total := atomic.LoadInt64(&c.statLoadDur)
+	if c.PenalizeLoadFailures {
+		count += atomic.LoadInt64(&c.statLoadFailCount)
+		total += atomic.LoadInt64(&c.statLoadFailDur)
+	}
+	if count == 0 {
+		return emptyDuration
+	}
+	return time.Duration(total / count)
+}
+
+// recordLoadDuration counts the load in its bucket if TrackLoadDurations is
+// set, which costs a single atomic add
+func (c *PowerCache) recordLoadDuration(hist *[loadBuckets]int64, d time.Duration) {
+	if !c.TrackLoadDurations {
+		return
+	}
+	i := bits.Len64(uint64(d / time.Microsecond))
+	if i >= loadBuckets {
+		i = loadBuckets - 1
+	}
+	atomic.AddInt64(&hist[i], 1)
+}
+
+// LoadDurationPercentile is how long loads took at the p-th percentile, once
+// TrackLoadDurations is set. p is between 0 and 1, anything outside is taken
+// as the nearer of the two. Loads are only counted in buckets that double in
+// size, so it's the upper bound of the bucket the percentile falls in: no
+// more than twice the real duration. Failed loads only count with
+// PenalizeLoadFailures, like AverageLoadPenalty. It is 0 until something has
+// been loaded.
+func (c *PowerCache) LoadDurationPercentile(p float64) time.Duration {
+	var hist [loadBuckets]int64
+	total := int64(0)
+	for i := range hist {
+		hist[i] = atomic.LoadInt64(&c.statLoadHist[i])
+		if c.PenalizeLoadFailures {
+			hist[i] += atomic.LoadInt64(&c.statLoadFailHist[i])
+		}
+		total += hist[i]
+	}
+	if total == 0 {
+		return emptyDuration
+	}
+	p = math.Min(math.Max(p, 0), 1)
+	//The rank of the sample at p, counting from 1
+	rank := int64(p*float64(total) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	seen := int64(0)
+	for i, n := range hist {
+		seen += n
+		if seen >= rank {
+			return time.Microsecond << uint(i)
+		}
+	}
+	return time.Microsecond << uint(loadBuckets-1)
+}
+
+func (c *PowerCache) EvictionCount() int64 {
+	return atomic.LoadInt64(&c.statEvictions)
+}
+
+// TakeEvictionCount returns EvictionCount and zeroes it, along with the counts
+// by cause, in one step so a scraper reporting deltas never counts an eviction
+// twice or misses one that happened between a read and a reset.
+func (c *PowerCache) TakeEvictionCount() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.statCauses {
+		atomic.StoreInt64(&c.statCauses[i], 0)
+	}
+	return atomic.SwapInt64(&c.statEvictions, 0)
+}
+
+func (c *PowerCache) LoadCount() int64 {
+	return atomic.LoadInt64(&c.statLoadCount) + atomic.LoadInt64(&c.statLoadFailCount)
+}
+
+func (c *PowerCache) LoadSuccessCount() int64 {
+	return atomic.LoadInt64(&c.statLoadCount)
+}
+
+func (c *PowerCache) LoadFailureCount() int64 {
+	return atomic.LoadInt64(&c.statLoadFailCount)
 }
@@ -0,0 +1,55 @@
+package cache
+
+import (
+	"time"
+)
+
+// startRefresher reloads every key each time ticks fires until Close is
+// called, then runs stop. Loads go through RefreshAll so they respect
+// MaxConcurrentLoads, and a refresh that overruns the interval just makes
+// the next one wait.
+func (c *PowerCache) startRefresher(ticks <-chan time.Time, stop func()) {
+	//The goroutine keeps its own copies, Close clears the fields
+	closing := make(chan struct{})
+	closed := make(chan struct{})
+	c.closing = closing
+	c.closed = closed
+	go func() {
+		defer close(closed)
+		defer stop()
+		for {
+			select {
+			case <-ticks:
+				c.RefreshAll(c.keys(), c.MaxConcurrentLoads)
+			case <-closing:
+				return
+			}
+		}
+	}()
+}
+
+// keys copies out every key so they can be worked on without the lock
+func (c *PowerCache) keys() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Close stops the background refresher started for RefreshInterval, waiting
+// for a refresh in progress to finish. It is safe to call more than once or
+// on a cache that has no refresher.
+func (c *PowerCache) Close() {
+	c.mu.Lock()
+	closing, closed := c.closing, c.closed
+	c.closing, c.closed = nil, nil
+	c.mu.Unlock()
+	if closing == nil {
+		return
+	}
+	close(closing)
+	<-closed
+}
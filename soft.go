@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// softShrinkFraction is how much of a SoftCache is shed on each poll that
+// finds the heap over its limit
+const softShrinkFraction = 0.25
+
+// SoftCache is a PowerCache that gives memory back when the heap grows too
+// big. Go has no soft or weak references to let the garbage collector pick
+// what to drop, so instead the heap is polled with runtime.ReadMemStats and
+// every poll that finds it over maxHeap sheds a quarter of the entries with
+// Shrink, lowest priority first. The heap only shrinks once the collector has
+// run, so it sheds at most once per poll rather than until it's under.
+type SoftCache struct {
+	*PowerCache
+	maxHeap   uint64
+	heapAlloc func() uint64
+	closing   chan struct{}
+	closed    chan struct{}
+	stopping  sync.Once
+}
+
+// NewSoftCache wraps c, configured as usual, polling the heap every interval
+// until Close is called. It returns ErrInvalidOption if interval isn't
+// positive.
+func NewSoftCache(c *PowerCache, maxHeap uint64, interval time.Duration) (*SoftCache, error) {
+	if interval <= 0 {
+		return nil, ErrInvalidOption
+	}
+	s := &SoftCache{PowerCache: c, maxHeap: maxHeap, heapAlloc: readHeapAlloc}
+	t := time.NewTicker(interval)
+	s.start(t.C, t.Stop)
+	return s, nil
+}
+
+// readHeapAlloc is how many bytes of heap are allocated right now
+func readHeapAlloc() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// start sheds entries each time ticks fires until Close is called, then runs
+// stop
+func (s *SoftCache) start(ticks <-chan time.Time, stop func()) {
+	s.closing = make(chan struct{})
+	s.closed = make(chan struct{})
+	go func() {
+		defer close(s.closed)
+		defer stop()
+		for {
+			select {
+			case <-ticks:
+				s.shed()
+			case <-s.closing:
+				return
+			}
+		}
+	}()
+}
+
+// shed shrinks the cache if the heap is over its limit, returning how many
+// entries it removed
+func (s *SoftCache) shed() int {
+	if s.heapAlloc() <= s.maxHeap {
+		return 0
+	}
+	return s.Shrink(softShrinkFraction)
+}
+
+// Close stops polling the heap, then closes the PowerCache. It is safe to
+// call more than once.
+func (s *SoftCache) Close() {
+	s.stopping.Do(func() {
+		close(s.closing)
+	})
+	<-s.closed
+	s.PowerCache.Close()
+}
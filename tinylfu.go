@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"hash/fnv"
+)
+
+const sketchDepth = 4
+
+// frequencySketch is a count-min sketch estimating how often each key has been
+// used recently. Counters saturate at 15 and are all halved once enough
+// increments have been seen, so keys that were hot a long time ago fade out.
+// Every method expects the cache lock to be held.
+type frequencySketch struct {
+	rows      [sketchDepth][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+func newFrequencySketch(size int) *frequencySketch {
+	width := 16
+	for width < size {
+		width *= 2
+	}
+	s := &frequencySketch{mask: uint64(width - 1), resetAt: width * 10}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// indexes spreads the key over every row by double hashing a single fnv hash
+func (s *frequencySketch) indexes(key string) [sketchDepth]uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	var idx [sketchDepth]uint64
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+	return idx
+}
+
+func (s *frequencySketch) increment(key string) {
+	idx := s.indexes(key)
+	for i, j := range idx {
+		if s.rows[i][j] < 15 {
+			s.rows[i][j]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] /= 2
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+func (s *frequencySketch) estimate(key string) uint8 {
+	idx := s.indexes(key)
+	min := uint8(15)
+	for i, j := range idx {
+		if s.rows[i][j] < min {
+			min = s.rows[i][j]
+		}
+	}
+	return min
+}
+
+// admit decides whether a new key gets in when the cache is full. Victims are
+// only evicted for as long as the key has been used more often than them,
+// otherwise the key is turned away and the incumbents stay. The caller must
+// hold the lock.
+func (c *PowerCache) admit(key string, removed []removal) ([]removal, bool) {
+	if _, ok := c.values[key]; ok {
+		return removed, true
+	}
+	freq := c.sketch.estimate(key)
+	for c.overLimits() {
+		victim, ok := c.findVictim()
+		if !ok {
+			break
+		}
+		if c.sketch.estimate(victim) >= freq {
+			return removed, false
+		}
+		c.evict.raiseFloor(victim)
+		removed = c.discard(victim, Size, removed)
+	}
+	return removed, true
+}
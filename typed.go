@@ -0,0 +1,179 @@
+package cache
+
+import (
+	"time"
+)
+
+// valueStore keeps the values of a typed cache unboxed. The PowerCache only
+// holds a nil placeholder for each key and tells the store whenever a key
+// leaves. Every method expects the cache lock to be held.
+type valueStore interface {
+	boxed(key string) interface{}
+	accepts(value interface{}) bool
+	unbox(key string, value interface{})
+	drop(key string)
+	dropAll()
+}
+
+// valueOf is the key's value as it was put, for the RemovalListener and
+// anything else that hands values out of the maps in bulk. Typed caches hold
+// it in their store, other values are decoded. The caller must hold the lock.
+func (c *PowerCache) valueOf(key string) interface{} {
+	if c.store != nil {
+		return c.store.boxed(key)
+	}
+	return c.decode(c.values[key])
+}
+
+// putTyped stores a placeholder for the key, then has set store the real
+// value under the normalized key, under the same lock, if the key was let in
+func (c *PowerCache) putTyped(key string, set func(key string)) {
+	c.ensureInitialized()
+	key = c.normalize(key)
+	c.cleanUpIfNeccissary()
+	defer c.maintainInBackground()
+	c.mu.Lock()
+	removed := c.put(key, nil)
+	if _, ok := c.values[key]; ok {
+		set(key)
+	}
+	c.mu.Unlock()
+	c.notify(removed)
+}
+
+// getTyped does the bookkeeping of GetIfPresent, then has get read the real
+// value under the normalized key, under the same lock
+func (c *PowerCache) getTyped(key string, get func(key string) bool) error {
+	c.ensureInitialized()
+	key = c.normalize(key)
+	c.mu.Lock()
+	_, removed, err := c.lookup(key, true, time.Now())
+	if err == nil && !get(key) {
+		//Put straight into the PowerCache, so there's no typed value
+		err = ErrNotPresent
+	}
+	c.mu.Unlock()
+	c.notify(removed)
+	return err
+}
+
+// BytesCache stores []byte values without boxing them in an interface{}, so
+// a Put doesn't allocate just to hold the value. Eviction, expiry and stats
+// all come from the PowerCache it wraps, which is configured as usual but
+// should only be written to through the BytesCache afterwards. The values are
+// stored as given, and the Weigher, Sizer, CloneFunc and ValueLoader are never
+// given them.
+type BytesCache struct {
+	c      *PowerCache
+	values map[string][]byte
+}
+
+func NewBytesCache(c *PowerCache) *BytesCache {
+	c.ensureInitialized()
+	s := &BytesCache{c: c, values: make(map[string][]byte)}
+	c.mu.Lock()
+	c.store = s
+	c.mu.Unlock()
+	return s
+}
+
+func (s *BytesCache) Put(key string, value []byte) {
+	s.c.putTyped(key, func(key string) { s.values[key] = value })
+}
+
+func (s *BytesCache) GetIfPresent(key string) ([]byte, error) {
+	var v []byte
+	err := s.c.getTyped(key, func(key string) bool {
+		var ok bool
+		v, ok = s.values[key]
+		return ok
+	})
+	return v, err
+}
+
+func (s *BytesCache) Invalidate(key string) {
+	s.c.Invalidate(key)
+}
+
+func (s *BytesCache) Length() int {
+	return s.c.Length()
+}
+
+func (s *BytesCache) boxed(key string) interface{} {
+	return s.values[key]
+}
+
+func (s *BytesCache) accepts(value interface{}) bool {
+	_, ok := value.([]byte)
+	return ok
+}
+
+func (s *BytesCache) unbox(key string, value interface{}) {
+	s.values[key] = value.([]byte)
+}
+
+func (s *BytesCache) drop(key string) {
+	delete(s.values, key)
+}
+
+func (s *BytesCache) dropAll() {
+	s.values = make(map[string][]byte)
+}
+
+// StringCache is BytesCache for string values
+type StringCache struct {
+	c      *PowerCache
+	values map[string]string
+}
+
+func NewStringCache(c *PowerCache) *StringCache {
+	c.ensureInitialized()
+	s := &StringCache{c: c, values: make(map[string]string)}
+	c.mu.Lock()
+	c.store = s
+	c.mu.Unlock()
+	return s
+}
+
+func (s *StringCache) Put(key string, value string) {
+	s.c.putTyped(key, func(key string) { s.values[key] = value })
+}
+
+func (s *StringCache) GetIfPresent(key string) (string, error) {
+	var v string
+	err := s.c.getTyped(key, func(key string) bool {
+		var ok bool
+		v, ok = s.values[key]
+		return ok
+	})
+	return v, err
+}
+
+func (s *StringCache) Invalidate(key string) {
+	s.c.Invalidate(key)
+}
+
+func (s *StringCache) Length() int {
+	return s.c.Length()
+}
+
+func (s *StringCache) boxed(key string) interface{} {
+	return s.values[key]
+}
+
+func (s *StringCache) accepts(value interface{}) bool {
+	_, ok := value.(string)
+	return ok
+}
+
+func (s *StringCache) unbox(key string, value interface{}) {
+	s.values[key] = value.(string)
+}
+
+func (s *StringCache) drop(key string) {
+	delete(s.values, key)
+}
+
+func (s *StringCache) dropAll() {
+	s.values = make(map[string]string)
+}
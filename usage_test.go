@@ -1,7 +1,17 @@
 package cache
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -83,3 +93,3706 @@ func TestExpiresAfterAccess(t *testing.T) {
 		t.Error("Should have evicted a")
 	}
 }
+
+func TestLoadCount(t *testing.T) {
+	c := NewPowerCache()
+
+	c.GetWithValueLoader("a", fetchFunc)
+	c.GetWithValueLoader("b", fetchFunc)
+	c.GetWithValueLoader("c", fetchFunc)
+	//Already present, should not load again
+	c.GetWithValueLoader("a", fetchFunc)
+
+	if c.LoadCount() != 3 {
+		t.Error("Should have loaded 3 times, got", c.LoadCount())
+	}
+}
+
+func TestLoadFailureCount(t *testing.T) {
+	c := NewPowerCache()
+
+	calls := 0
+	flaky := func(key string) (interface{}, error) {
+		calls++
+		time.Sleep(time.Millisecond)
+		if calls%2 == 0 {
+			return nil, ErrNotPresent
+		}
+		return key, nil
+	}
+
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		c.GetWithValueLoader(k, flaky)
+	}
+
+	if c.LoadSuccessCount() != 3 {
+		t.Error("Should have 3 successful loads, got", c.LoadSuccessCount())
+	}
+	if c.LoadFailureCount() != 2 {
+		t.Error("Should have 2 failed loads, got", c.LoadFailureCount())
+	}
+	if c.LoadCount() != 5 {
+		t.Error("Should have 5 total loads, got", c.LoadCount())
+	}
+	//Failed keys should not be cached
+	if _, err := c.GetIfPresent("b"); err != ErrNotPresent {
+		t.Error("Should not have cached a failed load")
+	}
+
+	penalty := c.AverageLoadPenalty()
+	if penalty < time.Millisecond {
+		t.Error("Average load penalty should be at least the loader duration, got", penalty)
+	}
+	c.PenalizeLoadFailures = true
+	if c.AverageLoadPenalty() < time.Millisecond {
+		t.Error("Average load penalty with failures should be at least the loader duration, got", c.AverageLoadPenalty())
+	}
+}
+
+func TestMissCount(t *testing.T) {
+	c := NewPowerCache()
+
+	c.Put("a", "a")
+	c.Put("b", "b")
+	c.GetIfPresent("a")
+	c.GetIfPresent("b")
+	c.GetIfPresent("c")
+	c.GetWithValueLoader("d", fetchFunc)
+	c.GetIfPresent("d")
+
+	if c.HitCount() != 3 {
+		t.Error("Should have 3 hits, got", c.HitCount())
+	}
+	if c.MissCount() != 2 {
+		t.Error("Should have 2 misses, got", c.MissCount())
+	}
+	if c.MissCount()+c.HitCount() != c.RequestCount() {
+		t.Error("Misses and hits should add up to requests")
+	}
+	if c.MissRate()+c.HitRate() != 1.0 {
+		t.Error("Miss rate and hit rate should add up to 1")
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Minute
+
+	c.Put("a", "a")
+	c.Put("b", 2)
+	c.PutWithTTL("c", "c", time.Millisecond)
+	c.SetWeight("b", 5)
+	time.Sleep(time.Millisecond * 2)
+
+	var buf bytes.Buffer
+	if err := c.SaveToWriter(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewPowerCache()
+	d.ExpiresAfterWriteDuration = time.Minute
+	if err := d.LoadFromReader(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := d.GetIfPresent("a"); v != "a" {
+		t.Error("Should have restored a")
+	}
+	if v, _ := d.GetIfPresent("b"); v != 2 {
+		t.Error("Should have restored b")
+	}
+	if _, err := d.GetIfPresent("c"); err != ErrNotPresent {
+		t.Error("Should have discarded expired c")
+	}
+	cd, _ := c.deadlineOf("a")
+	dd, _ := d.deadlineOf("a")
+	if !dd.Equal(cd) {
+		t.Error("Should have restored the expiry of a")
+	}
+	if d.weight["b"] != 5 {
+		t.Error("Should have restored the weight of b")
+	}
+}
+
+func TestExportJSON(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Minute
+
+	c.Put("a", "a")
+	c.Put("b", make(chan int))
+	c.PutWithTTL("c", "c", time.Millisecond)
+	time.Sleep(time.Millisecond * 2)
+
+	var buf bytes.Buffer
+	if err := c.ExportJSON(&buf, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatal("Should have exported 2 entries, got", len(entries))
+	}
+	if entries[0]["key"] != "a" || entries[0]["value"] != "a" {
+		t.Error("Should have exported a with its value")
+	}
+	if entries[0]["ttl"] == nil {
+		t.Error("Should have exported a ttl for a")
+	}
+	if entries[1]["key"] != "b" || entries[1]["value"] != "<unserializable chan int>" {
+		t.Error("Should have exported a placeholder for b, got", entries[1]["value"])
+	}
+
+	buf.Reset()
+	c.ExportJSON(&buf, false)
+	var keysOnly []map[string]interface{}
+	json.Unmarshal(buf.Bytes(), &keysOnly)
+	if _, ok := keysOnly[0]["value"]; ok {
+		t.Error("Should not have exported values")
+	}
+}
+
+// expvar names can't be reused, so each run (like with -count) needs its own
+var expvarRuns int64
+
+func TestPublishExpvar(t *testing.T) {
+	name := fmt.Sprint("TestPublishExpvar", atomic.AddInt64(&expvarRuns, 1))
+	c := NewPowerCache()
+	c.PublishExpvar(name)
+
+	c.Put("a", "a")
+	c.GetIfPresent("a")
+	c.GetIfPresent("b")
+	c.GetWithValueLoader("c", fetchFunc)
+
+	var s Stats
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Hits != 1 || s.Misses != 2 || s.Requests != 3 {
+		t.Error("Should have published current request stats, got", s)
+	}
+	if s.LoadSuccesses != 1 {
+		t.Error("Should have published current load stats, got", s)
+	}
+
+	c.GetIfPresent("a")
+	json.Unmarshal([]byte(expvar.Get(name).String()), &s)
+	if s.Hits != 2 {
+		t.Error("Should have read stats again on serialization, got", s)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterAccessDuration = time.Millisecond * 10
+	c.MaxAge = time.Millisecond * 30
+
+	start := time.Now()
+	c.Put("a", "a")
+
+	//Keep accessing well within the access window
+	for time.Now().Sub(start) < time.Millisecond*60 {
+		_, err := c.GetIfPresent("a")
+		if err == ErrNotPresent {
+			if time.Now().Sub(start) < c.MaxAge {
+				t.Error("Should not have evicted a before MaxAge")
+			}
+			return
+		}
+		time.Sleep(time.Millisecond * 2)
+	}
+	t.Error("Should have evicted a at MaxAge despite constant access")
+}
+
+func TestExpiresAfterWriteAndAccess(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Millisecond * 60
+	c.ExpiresAfterAccessDuration = time.Millisecond * 25
+
+	c.Put("a", "a")
+	c.Put("b", "b")
+	written := c.wtime["a"]
+
+	//Reading a keeps it inside the access window, b goes idle
+	for i := 0; i < 5; i++ {
+		time.Sleep(time.Millisecond * 8)
+		if _, err := c.GetIfPresent("a"); err != nil {
+			t.Error("Should not have evicted a inside both windows")
+		}
+	}
+	if !c.wtime["a"].Equal(written) {
+		t.Error("Reading should not change the write time")
+	}
+	if !c.atime["a"].After(written) {
+		t.Error("Reading should move the access time")
+	}
+	if _, err := c.GetIfPresent("b"); err != ErrNotPresent {
+		t.Error("Should have evicted b after the access window")
+	}
+
+	//Access alone can't keep a past the write window
+	time.Sleep(time.Millisecond * 25)
+	if _, err := c.GetIfPresent("a"); err != ErrNotPresent {
+		t.Error("Should have evicted a after the write window")
+	}
+}
+
+func TestExpiringCacheAccessBoundary(t *testing.T) {
+	c := NewExpiringCache(time.Millisecond*10, time.Minute)
+
+	c.Put("a", "a")
+	time.Sleep(time.Millisecond * 20)
+
+	if _, err := c.GetIfPresent("a"); err != ErrNotPresent {
+		t.Error("Should have evicted a after the access window")
+	}
+}
+
+func TestExpiringCacheWriteBoundary(t *testing.T) {
+	c := NewExpiringCache(time.Millisecond*20, time.Millisecond*40)
+
+	start := time.Now()
+	c.Put("a", "a")
+
+	for time.Now().Sub(start) < time.Millisecond*80 {
+		_, err := c.GetIfPresent("a")
+		if err == ErrNotPresent {
+			if time.Now().Sub(start) < time.Millisecond*40 {
+				t.Error("Should not have evicted a before the write window")
+			}
+			return
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	t.Error("Should have evicted a after the write window despite access")
+}
+
+func TestCleanUpEvictsUntilUnderLimits(t *testing.T) {
+	c := NewPowerCache()
+	for i := 0; i < 20; i++ {
+		c.Put(fmt.Sprint(i), i)
+	}
+
+	c.MaxKeys = 5
+	c.CleanUp()
+	if c.Length() >= c.MaxKeys {
+		t.Error("Should have evicted down under MaxKeys, got", c.Length())
+	}
+
+	c.MaxKeys = 0
+	for i := 0; i < 20; i++ {
+		c.Put(fmt.Sprint(i), i)
+	}
+	c.MaxWeight = 8
+	c.CleanUp()
+	if c.totalWeight >= c.MaxWeight {
+		t.Error("Should have evicted down under MaxWeight, got", c.totalWeight)
+	}
+}
+
+func TestCleanUpKeepsLiveKeysUnderLimits(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Minute
+	c.MaxKeys = 10
+
+	c.Put("a", "a")
+	c.Put("b", "b")
+	c.CleanUp()
+	if c.Length() != 2 {
+		t.Error("Should not have evicted anything under the limits, got", c.Length())
+	}
+}
+
+func TestEvictionHeapTracksEntries(t *testing.T) {
+	c := NewPowerCache()
+	c.MaxKeys = 50
+	for i := 0; i < 100; i++ {
+		c.Put(fmt.Sprint(i), i)
+		c.GetIfPresent(fmt.Sprint(i / 2))
+	}
+	c.Invalidate("99")
+	c.Invalidate("98")
+
+	if c.evict.Len() != c.Length() {
+		t.Error("Eviction heap should track every entry", c.evict.Len(), c.Length())
+	}
+	//The most recently used keys should have survived
+	if _, err := c.GetIfPresent("97"); err != nil {
+		t.Error("Should not have evicted a recent key")
+	}
+}
+
+func TestPutWithTTL(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Millisecond * 10
+
+	c.PutWithTTL("a", "a", time.Hour)
+	c.PutWithTTL("b", "b", time.Millisecond*20)
+	c.Put("c", "c")
+
+	time.Sleep(time.Millisecond * 15)
+	if _, err := c.GetIfPresent("a"); err != nil {
+		t.Error("Should have kept a with its longer TTL")
+	}
+	if _, err := c.GetIfPresent("b"); err != nil {
+		t.Error("Should have kept b with its longer TTL")
+	}
+	if _, err := c.GetIfPresent("c"); err != ErrNotPresent {
+		t.Error("Should have evicted c with the default TTL")
+	}
+
+	time.Sleep(time.Millisecond * 10)
+	if _, err := c.GetIfPresent("b"); err != ErrNotPresent {
+		t.Error("Should have evicted b after its TTL")
+	}
+}
+
+func TestPutWithTTLWithoutExpiry(t *testing.T) {
+	c := NewPowerCache()
+	if err := c.PutWithTTL("a", "a", time.Millisecond); err != ErrNoExpiry {
+		t.Error("Should have rejected a ttl on a cache without expiry, got", err)
+	}
+	time.Sleep(time.Millisecond * 2)
+	c.CleanUp()
+	if _, err := c.GetIfPresent("a"); err != ErrNotPresent {
+		t.Error("Should not have stored a value whose ttl can't be honored")
+	}
+
+	c = NewExpiresAfterWriteCache(time.Minute).(*PowerCache)
+	if err := c.PutWithTTL("a", "a", 0); err != ErrExpiresInPast {
+		t.Error("Should have rejected a ttl that isn't positive, got", err)
+	}
+}
+
+func TestPutWithTTLIsAtomic(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Minute
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			c.PutWithTTL(fmt.Sprint(i), i, time.Hour)
+		}
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		c.mu.RLock()
+		for k := range c.values {
+			if _, ok := c.deadline[k]; !ok {
+				t.Error("Should never see a key without its custom deadline", k)
+			}
+		}
+		c.mu.RUnlock()
+	}
+}
+
+func TestSetExpiresAt(t *testing.T) {
+	c := NewPowerCache()
+	c.Put("a", "a")
+	if err := c.SetExpiresAt("a", time.Now().Add(time.Minute)); err != ErrNoExpiry {
+		t.Error("Should have rejected a deadline on a cache without expiry, got", err)
+	}
+
+	c = NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Minute
+	c.Put("a", "a")
+	if err := c.SetExpiresAt("a", time.Now().Add(-time.Second)); err != ErrExpiresInPast {
+		t.Error("Should have rejected a deadline in the past, got", err)
+	}
+	if _, err := c.GetIfPresent("a"); err != nil {
+		t.Error("Should not have evicted a after a rejected deadline")
+	}
+
+	if err := c.SetExpiresAt("a", time.Now().Add(time.Millisecond*5)); err != nil {
+		t.Error("Should have accepted a future deadline, got", err)
+	}
+	time.Sleep(time.Millisecond * 10)
+	if _, err := c.GetIfPresent("a"); err != ErrNotPresent {
+		t.Error("Should have evicted a at its deadline")
+	}
+}
+
+func TestSetWeightOverMaxWeight(t *testing.T) {
+	c := NewPowerCache()
+	c.MaxWeight = 10
+
+	c.Put("a", "a")
+	c.Put("b", "b")
+	if err := c.SetWeight("a", 11); err != ErrWeightTooLarge {
+		t.Error("Should have rejected a weight over MaxWeight, got", err)
+	}
+	if c.weight["a"] != 1 || c.totalWeight != 2 {
+		t.Error("Should have left the weight alone", c.weight["a"], c.totalWeight)
+	}
+
+	if err := c.SetWeight("a", 5); err != nil {
+		t.Error("Should have accepted a weight under MaxWeight, got", err)
+	}
+	if c.totalWeight != 6 {
+		t.Error("Should have updated the total weight, got", c.totalWeight)
+	}
+}
+
+func TestNegativeCaching(t *testing.T) {
+	c := NewPowerCache()
+	c.NegativeTTL = time.Millisecond * 20
+
+	calls := 0
+	c.ValueLoader = func(key string) (interface{}, error) {
+		calls++
+		return nil, ErrNotFound
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.Get("a"); !errors.Is(err, ErrNotFound) {
+			t.Error("Should have returned ErrNotFound, got", err)
+		}
+	}
+	if calls != 1 {
+		t.Error("Should have only called the loader once, got", calls)
+	}
+	if _, err := c.GetIfPresent("a"); !errors.Is(err, ErrNotFound) {
+		t.Error("Should have returned the cached miss, got", err)
+	}
+	if _, err := c.GetIfPresent("b"); err != ErrNotPresent {
+		t.Error("Should not have a cached miss for b, got", err)
+	}
+
+	time.Sleep(time.Millisecond * 25)
+	c.Get("a")
+	if calls != 2 {
+		t.Error("Should have called the loader again after NegativeTTL, got", calls)
+	}
+
+	//Putting a real value replaces the negative
+	c.Put("a", "a")
+	if v, _ := c.GetIfPresent("a"); v != "a" {
+		t.Error("Should have replaced the cached miss")
+	}
+}
+
+// checkConsistent fails the test if any of the per key maps hold a key that
+// isn't in values
+func checkConsistent(t *testing.T, c *PowerCache) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	n := len(c.values)
+	if len(c.wtime) != n || len(c.atime) != n || len(c.rtime) != n || len(c.weight) != n || c.evict.Len()+len(c.pinned) != n {
+		t.Error("Per key maps out of sync with values", n, len(c.wtime), len(c.atime), len(c.weight), c.evict.Len())
+	}
+	for k := range c.deadline {
+		if _, ok := c.values[k]; !ok {
+			t.Error("Deadline leaked for missing key", k)
+		}
+	}
+}
+
+func TestNoOrphanedEntries(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Minute
+
+	c.Put("a", "a")
+	c.Put("b", "b")
+	c.Put("c", "c")
+	checkConsistent(t, c)
+
+	c.Invalidate("a")
+	checkConsistent(t, c)
+	c.GetIfPresent("a")
+	checkConsistent(t, c)
+
+	//Touching missing keys shouldn't create entries
+	c.SetWeight("a", 3)
+	c.SetExpiresIn("a", time.Hour)
+	c.SetExpiresAt("a", time.Now().Add(time.Hour))
+	c.Invalidate("z")
+	checkConsistent(t, c)
+
+	c.SetWeight("b", 3)
+	c.SetExpiresIn("b", time.Hour)
+	c.Invalidate("b")
+	checkConsistent(t, c)
+
+	c.InvalidateAll()
+	checkConsistent(t, c)
+}
+
+func TestWeightedSize(t *testing.T) {
+	c := NewPowerCache()
+
+	c.Put("a", "a")
+	c.Put("b", "b")
+	c.Put("c", "c")
+	if c.WeightedSize() != 3 {
+		t.Error("Should have a weighted size of 3, got", c.WeightedSize())
+	}
+
+	c.SetWeight("a", 4)
+	c.SetWeight("b", 2)
+	if c.WeightedSize() != 7 {
+		t.Error("Should have a weighted size of 7, got", c.WeightedSize())
+	}
+
+	c.Invalidate("a")
+	if c.WeightedSize() != 3 {
+		t.Error("Should have a weighted size of 3 after invalidating a, got", c.WeightedSize())
+	}
+
+	c.MaxWeight = 2
+	c.CleanUp()
+	if c.WeightedSize() >= 2 {
+		t.Error("Should have evicted under MaxWeight, got", c.WeightedSize())
+	}
+
+	c.InvalidateAll()
+	if c.WeightedSize() != 0 {
+		t.Error("Should have a weighted size of 0 after InvalidateAll, got", c.WeightedSize())
+	}
+}
+
+func TestInvalidateExpired(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Minute
+	c.MaxKeys = 4
+
+	removed := make(map[string]RemovalCause)
+	c.RemovalListener = func(key string, value interface{}, cause RemovalCause) {
+		removed[key] = cause
+	}
+
+	c.PutWithTTL("a", "a", time.Millisecond)
+	c.PutWithTTL("b", "b", time.Millisecond)
+	c.Put("c", "c")
+	time.Sleep(time.Millisecond * 2)
+	c.mu.Lock()
+	//Over the limit, but InvalidateExpired should only care about expiry
+	c.put("d", "d")
+	c.put("e", "e")
+	c.mu.Unlock()
+
+	if n := c.InvalidateExpired(); n != 2 {
+		t.Error("Should have removed 2 expired entries, got", n)
+	}
+	if c.Length() != 3 {
+		t.Error("Should have kept the 3 fresh entries, got", c.Length())
+	}
+	if removed["a"] != Expired || removed["b"] != Expired || len(removed) != 2 {
+		t.Error("Should have told the listener about a and b expiring", removed)
+	}
+}
+
+func TestGetWithTTL(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Minute
+	c.Put("a", "a")
+	time.Sleep(time.Millisecond * 5)
+	v, ttl, err := c.GetWithTTL("a")
+	if v != "a" || err != nil {
+		t.Error("Should have returned a", v, err)
+	}
+	if ttl > time.Minute-time.Millisecond*5 || ttl < time.Minute-time.Second {
+		t.Error("Should have a ttl just under a minute, got", ttl)
+	}
+
+	c = NewPowerCache()
+	c.ExpiresAfterAccessDuration = time.Minute
+	c.Put("a", "a")
+	time.Sleep(time.Millisecond * 5)
+	_, ttl, _ = c.GetWithTTL("a")
+	if ttl < time.Minute-time.Millisecond {
+		t.Error("Should have reset the access ttl to a minute, got", ttl)
+	}
+
+	c = NewPowerCache()
+	c.Put("a", "a")
+	if _, ttl, _ = c.GetWithTTL("a"); ttl != NoExpiration {
+		t.Error("Should have returned NoExpiration, got", ttl)
+	}
+	if _, _, err = c.GetWithTTL("b"); err != ErrNotPresent {
+		t.Error("Should not have found b, got", err)
+	}
+}
+
+func TestConcurrentStats(t *testing.T) {
+	c := NewPowerCache()
+	c.MaxKeys = 10
+	c.ValueLoader = func(key string) (interface{}, error) {
+		return key, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				c.Get(fmt.Sprint(j % 20))
+				c.Put(fmt.Sprint(i, j), j)
+			}
+		}(i)
+	}
+	for i := 0; i < 200; i++ {
+		if rate := c.HitRate(); rate < 0 || rate > 1 {
+			t.Error("Hit rate out of range", rate)
+		}
+		c.EvictionCount()
+		c.Stats()
+	}
+	wg.Wait()
+
+	if c.HitCount()+c.MissCount() != 800 {
+		t.Error("Should have counted every request, got", c.RequestCount())
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	c := NewPowerCache()
+	c.GetWithValueLoader("a", fetchFunc)
+	c.GetIfPresent("a")
+	c.GetIfPresent("a")
+	c.Put("b", "b")
+	c.Invalidate("b")
+
+	c.ResetStats()
+	if c.HitRate() != 0 || c.RequestCount() != 0 || c.EvictionCount() != 0 || c.LoadCount() != 0 {
+		t.Error("Should have zeroed the stats", c.Stats())
+	}
+	if c.AverageLoadPenalty() != 0 {
+		t.Error("Should have zeroed the load penalty", c.AverageLoadPenalty())
+	}
+	if _, err := c.GetIfPresent("a"); err != nil {
+		t.Error("Should have kept the entries")
+	}
+	if c.HitRate() != 1 {
+		t.Error("Should count from the reset, got", c.HitRate())
+	}
+}
+
+func TestOnLoad(t *testing.T) {
+	c := NewPowerCache()
+
+	var keys []string
+	var durs []time.Duration
+	var errs []error
+	c.OnLoad = func(key string, dur time.Duration, err error) {
+		keys = append(keys, key)
+		durs = append(durs, dur)
+		errs = append(errs, err)
+		//Hooks run outside the lock so they may use the cache
+		c.Length()
+	}
+
+	c.GetWithValueLoader("a", func(key string) (interface{}, error) {
+		time.Sleep(time.Millisecond * 5)
+		return key, nil
+	})
+	c.GetWithValueLoader("b", func(key string) (interface{}, error) {
+		return nil, ErrNotPresent
+	})
+	c.GetWithValueLoader("a", fetchFunc)
+
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Fatal("Should have called the hook once per load", keys)
+	}
+	if durs[0] < time.Millisecond*5 || durs[0] > time.Millisecond*50 {
+		t.Error("Should have reported the load duration, got", durs[0])
+	}
+	if errs[0] != nil || errs[1] != ErrNotPresent {
+		t.Error("Should have passed along the loader errors", errs)
+	}
+}
+
+func TestMaxCleanUpScan(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Minute
+	c.MaxCleanUpScan = 10
+	for i := 0; i < 100; i++ {
+		c.PutWithTTL(fmt.Sprint(i), i, time.Millisecond)
+	}
+	time.Sleep(time.Millisecond * 2)
+
+	c.CleanUp()
+	if c.Length() != 90 {
+		t.Error("Should have only swept 10 entries, got", 100-c.Length())
+	}
+	//InvalidateExpired always sweeps everything
+	c.InvalidateExpired()
+	if c.Length() != 0 {
+		t.Error("Should have swept every expired entry, got", c.Length())
+	}
+}
+
+func TestSampledCacheEvictsOldKeys(t *testing.T) {
+	c := NewSampledCache(100, 5)
+	for i := 0; i < 100; i++ {
+		c.Put(fmt.Sprint("old", i), i)
+	}
+	time.Sleep(time.Millisecond)
+	//Touch half of them so they are recently used
+	for i := 50; i < 100; i++ {
+		c.GetIfPresent(fmt.Sprint("old", i))
+	}
+	time.Sleep(time.Millisecond)
+	for i := 0; i < 50; i++ {
+		c.Put(fmt.Sprint("new", i), i)
+	}
+
+	//Most evictions should have come from the untouched half
+	survivors := 0
+	for i := 0; i < 50; i++ {
+		if _, err := c.GetIfPresent(fmt.Sprint("old", i)); err == nil {
+			survivors++
+		}
+	}
+	if survivors > 20 {
+		t.Error("Should have mostly evicted the least recently used keys, kept", survivors)
+	}
+	if c.(*PowerCache).Length() > 100 {
+		t.Error("Should have stayed within MaxKeys")
+	}
+}
+
+func TestCachedNil(t *testing.T) {
+	c := NewPowerCache()
+
+	c.Put("a", nil)
+	v, err := c.GetIfPresent("a")
+	if v != nil || err != nil {
+		t.Error("Should have returned the cached nil", v, err)
+	}
+	if _, err = c.GetIfPresent("b"); err != ErrNotPresent {
+		t.Error("Should have told absence apart from a cached nil", err)
+	}
+
+	calls := 0
+	nilLoader := func(key string) (interface{}, error) {
+		calls++
+		return nil, nil
+	}
+	c.GetWithValueLoader("a", nilLoader)
+	if calls != 0 {
+		t.Error("Should not have reloaded a cached nil")
+	}
+	c.GetWithValueLoader("b", nilLoader)
+	c.GetWithValueLoader("b", nilLoader)
+	if calls != 1 {
+		t.Error("Should have cached the nil the loader returned, got", calls)
+	}
+
+	var buf bytes.Buffer
+	if err := c.SaveToWriter(&buf); err != nil {
+		t.Fatal(err)
+	}
+	d := NewPowerCache()
+	if err := d.LoadFromReader(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.GetIfPresent("a"); v != nil || err != nil {
+		t.Error("Should have restored the cached nil", v, err)
+	}
+}
+
+func TestPutAll(t *testing.T) {
+	c := new(PowerCache)
+	c.InitialCapacity = 100
+	c.Initialize()
+
+	c.PutAll(map[string]interface{}{"a": 1, "b": 2, "c": 3})
+	if c.Length() != 3 {
+		t.Error("Should have stored every value, got", c.Length())
+	}
+	if v, _ := c.GetIfPresent("b"); v != 2 {
+		t.Error("Should have stored b")
+	}
+	checkConsistent(t, c)
+}
+
+func TestGetIfPresentNoTouch(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterAccessDuration = time.Millisecond * 20
+
+	start := time.Now()
+	c.Put("a", "a")
+	for time.Now().Sub(start) < time.Millisecond*40 {
+		_, err := c.GetIfPresentNoTouch("a")
+		if err == ErrNotPresent {
+			if time.Now().Sub(start) < time.Millisecond*20 {
+				t.Error("Should not have evicted a before its access window")
+			}
+			if c.HitCount() == 0 {
+				t.Error("Should have counted the peeks as hits")
+			}
+			return
+		}
+		time.Sleep(time.Millisecond * 2)
+	}
+	t.Error("Should have evicted a on schedule despite peeking")
+}
+
+func TestLoadWithoutLoader(t *testing.T) {
+	c := NewMaxKeysCache(10).(LoadingCache)
+
+	if _, err := c.Load("a"); err != ErrNoLoader {
+		t.Error("Should have returned ErrNoLoader, got", err)
+	}
+	if _, err := c.Get("a"); err != ErrNoLoader {
+		t.Error("Should have returned ErrNoLoader, got", err)
+	}
+	c.Refresh("a")
+	if _, err := c.GetWithValueLoader("a", nil); err != ErrNoLoader {
+		t.Error("Should have returned ErrNoLoader, got", err)
+	}
+}
+
+func newComparerCache(comparer Comparer) *PowerCache {
+	c := NewPowerCache()
+	c.MaxKeys = 3
+	c.Comparer = comparer
+	c.Put("a", "a")
+	time.Sleep(time.Millisecond)
+	c.Put("b", "b")
+	time.Sleep(time.Millisecond)
+	c.Put("c", "c")
+	c.SetWeight("a", 9)
+	c.SetWeight("b", 1)
+	c.SetWeight("c", 5)
+	c.Put("d", "d")
+	return c
+}
+
+func TestComparerByWeight(t *testing.T) {
+	c := newComparerCache(func(weighta, weightb int64, agea, ageb time.Duration) int64 {
+		return weighta - weightb
+	})
+	if _, err := c.GetIfPresent("b"); err != ErrNotPresent {
+		t.Error("Should have evicted the lightest key b")
+	}
+	if c.Length() != 3 {
+		t.Error("Should have evicted exactly one key, got", c.Length())
+	}
+}
+
+func TestComparerByAge(t *testing.T) {
+	c := newComparerCache(func(weighta, weightb int64, agea, ageb time.Duration) int64 {
+		return int64(ageb - agea)
+	})
+	if _, err := c.GetIfPresent("a"); err != ErrNotPresent {
+		t.Error("Should have evicted the oldest key a")
+	}
+	if c.Length() != 3 {
+		t.Error("Should have evicted exactly one key, got", c.Length())
+	}
+}
+
+func TestRefreshAll(t *testing.T) {
+	c := NewPowerCache()
+	c.ValueLoader = func(key string) (interface{}, error) {
+		if key == "b" || key == "d" {
+			return nil, ErrNotFound
+		}
+		return key + "!", nil
+	}
+	c.Put("a", "a")
+
+	errs := c.RefreshAll([]string{"a", "b", "c", "d"}, 2)
+	if len(errs) != 2 || !errors.Is(errs["b"], ErrNotFound) || !errors.Is(errs["d"], ErrNotFound) {
+		t.Error("Should have returned errors for exactly b and d", errs)
+	}
+	if v, _ := c.GetIfPresent("a"); v != "a!" {
+		t.Error("Should have reloaded a, got", v)
+	}
+	if v, _ := c.GetIfPresent("c"); v != "c!" {
+		t.Error("Should have loaded c, got", v)
+	}
+}
+
+func TestMaxConcurrentLoads(t *testing.T) {
+	c := new(PowerCache)
+	c.MaxConcurrentLoads = 3
+	c.Initialize()
+
+	var running, peak int64
+	c.ValueLoader = func(key string) (interface{}, error) {
+		n := atomic.AddInt64(&running, 1)
+		for {
+			p := atomic.LoadInt64(&peak)
+			if n <= p || atomic.CompareAndSwapInt64(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond * 2)
+		atomic.AddInt64(&running, -1)
+		return key, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.Get(fmt.Sprint(i))
+		}(i)
+	}
+	wg.Wait()
+
+	if peak > 3 {
+		t.Error("Should never have run more than 3 loads at once, got", peak)
+	}
+	if c.Length() != 20 {
+		t.Error("Should have loaded every key, got", c.Length())
+	}
+}
+
+func TestLoadTimeout(t *testing.T) {
+	c := new(PowerCache)
+	c.LoadTimeout = time.Millisecond * 10
+	c.Initialize()
+
+	c.ValueLoader = func(key string) (interface{}, error) {
+		if key == "slow" {
+			time.Sleep(time.Millisecond * 50)
+		}
+		return key, nil
+	}
+
+	if _, err := c.Get("slow"); err != ErrLoadTimeout {
+		t.Error("Should have timed out the slow load, got", err)
+	}
+	if _, err := c.GetIfPresent("slow"); err != ErrNotPresent {
+		t.Error("Should not have cached the timed out load")
+	}
+	if c.LoadFailureCount() != 1 {
+		t.Error("Should have counted the timeout as a failure")
+	}
+	if v, err := c.Get("fast"); err != nil || v != "fast" {
+		t.Error("Should have loaded the fast key, got", v, err)
+	}
+
+	//Let the abandoned load finish, it must not sneak into the cache
+	time.Sleep(time.Millisecond * 60)
+	if _, err := c.GetIfPresent("slow"); err != ErrNotPresent {
+		t.Error("Should not have cached the abandoned load")
+	}
+}
+
+func TestExpiresAt(t *testing.T) {
+	c := NewExpiresAfterWriteCache(time.Minute).(*PowerCache)
+
+	before := time.Now()
+	c.Put("a", "a")
+	after := time.Now()
+	d, ok := c.ExpiresAt("a")
+	if !ok {
+		t.Error("Should have found a")
+	}
+	if d.Before(before.Add(time.Minute)) || d.After(after.Add(time.Minute)) {
+		t.Error("Should expire a minute after the put, got", d.Sub(before))
+	}
+
+	before = time.Now()
+	c.SetExpiresIn("a", time.Second*10)
+	after = time.Now()
+	d, _ = c.ExpiresAt("a")
+	if d.Before(before.Add(time.Second*10)) || d.After(after.Add(time.Second*10)) {
+		t.Error("Should expire ten seconds after SetExpiresIn, got", d.Sub(before))
+	}
+
+	if _, ok := c.ExpiresAt("b"); ok {
+		t.Error("Should not have found b")
+	}
+	if c.RequestCount() != 0 {
+		t.Error("Should not have counted any requests")
+	}
+
+	p := NewPowerCache()
+	p.Put("a", "a")
+	if d, ok := p.ExpiresAt("a"); !ok || !d.IsZero() {
+		t.Error("Should report a zero deadline without an expiry policy, got", d, ok)
+	}
+}
+
+func zipfHitRate(c *PowerCache) float64 {
+	c.ValueLoader = func(key string) (interface{}, error) {
+		return key, nil
+	}
+	z := rand.NewZipf(rand.New(rand.NewSource(42)), 1.1, 1, 10000)
+	for i := 0; i < 20000; i++ {
+		c.Get(fmt.Sprint(z.Uint64()))
+	}
+	c.ResetStats()
+	for i := 0; i < 50000; i++ {
+		c.Get(fmt.Sprint(z.Uint64()))
+	}
+	return c.HitRate()
+}
+
+func TestTinyLFU(t *testing.T) {
+	lru := zipfHitRate(NewMaxKeysCache(100).(*PowerCache))
+	lfu := zipfHitRate(NewTinyLFUCache(100).(*PowerCache))
+	if lfu <= lru {
+		t.Error("Should have beaten plain LRU on a zipf workload, got", lfu, "vs", lru)
+	}
+
+	c := NewTinyLFUCache(3).(*PowerCache)
+	for _, k := range []string{"a", "b", "c"} {
+		c.Put(k, k)
+		c.GetIfPresent(k)
+	}
+	c.Put("d", "d")
+	if _, err := c.GetIfPresent("d"); err != ErrNotPresent {
+		t.Error("Should have turned away a key used less than the incumbents")
+	}
+	for i := 0; i < 3; i++ {
+		c.Put("d", "d")
+	}
+	if _, err := c.GetIfPresent("d"); err != nil {
+		t.Error("Should have admitted d once it was used more often")
+	}
+	if c.Length() > 3 {
+		t.Error("Should have stayed within MaxKeys, got", c.Length())
+	}
+	checkConsistent(t, c)
+}
+
+func TestInvalidateAllNotifies(t *testing.T) {
+	c := NewPowerCache()
+	seen := make(map[string]int)
+	c.RemovalListener = func(key string, value interface{}, cause RemovalCause) {
+		if cause != Explicit {
+			t.Error("Should have removed", key, "explicitly, got", cause)
+		}
+		//Listeners run outside the lock so they can use the cache
+		c.Length()
+		seen[key]++
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		c.Put(k, k)
+	}
+	c.InvalidateAll()
+
+	if len(seen) != 3 {
+		t.Error("Should have notified for every entry, got", seen)
+	}
+	for k, n := range seen {
+		if n != 1 {
+			t.Error("Should have notified once for", k, "got", n)
+		}
+	}
+	if c.Length() != 0 {
+		t.Error("Should have emptied the cache")
+	}
+}
+
+func TestEvictionsByCause(t *testing.T) {
+	c := new(PowerCache)
+	c.MaxKeys = 3
+	c.ExpiresAfterWriteDuration = time.Minute
+	c.Initialize()
+
+	c.Put("a", "a")
+	c.Put("a", "a")
+	c.Invalidate("a")
+	c.PutWithTTL("b", "b", time.Millisecond)
+	time.Sleep(time.Millisecond * 5)
+	c.GetIfPresent("b")
+	for _, k := range []string{"c", "d", "e", "f"} {
+		c.Put(k, k)
+	}
+	c.InvalidateAll()
+
+	s := c.Stats()
+	if s.ExplicitEvictions != 4 {
+		t.Error("Should have counted 4 explicit evictions, got", s.ExplicitEvictions)
+	}
+	if s.ExpiredEvictions != 1 {
+		t.Error("Should have counted 1 expired eviction, got", s.ExpiredEvictions)
+	}
+	if s.SizeEvictions != 1 {
+		t.Error("Should have counted 1 size eviction, got", s.SizeEvictions)
+	}
+	if s.Evictions != s.ExplicitEvictions+s.ExpiredEvictions+s.SizeEvictions {
+		t.Error("Should have totaled the causes, got", s.Evictions)
+	}
+
+	c.ResetStats()
+	if c.Stats().SizeEvictions != 0 {
+		t.Error("Should have reset the per cause counts")
+	}
+}
+
+func TestZeroWeights(t *testing.T) {
+	c := new(PowerCache)
+	c.MaxKeys = 3
+	c.Weigher = func(key string, value interface{}) int64 {
+		return 0
+	}
+	c.Initialize()
+
+	for _, k := range []string{"a", "b", "c"} {
+		c.Put(k, k)
+		time.Sleep(time.Millisecond * 2)
+	}
+	if c.WeightedSize() != 0 {
+		t.Error("Should have used the weigher, got", c.WeightedSize())
+	}
+	c.Put("d", "d")
+	if _, err := c.GetIfPresent("a"); err != ErrNotPresent {
+		t.Error("Should have evicted the oldest zero weight key")
+	}
+	for _, k := range []string{"b", "c", "d"} {
+		if _, err := c.GetIfPresent(k); err != nil {
+			t.Error("Should have kept", k)
+		}
+	}
+	checkConsistent(t, c)
+
+	//Keys written in the same instant must not score as NaN, only the
+	//hash tie-breaker should order them
+	now := time.Now()
+	c.atime["b"], c.atime["c"] = now, now
+	if c.evictsBefore("b", "c", now) == c.evictsBefore("c", "b", now) {
+		t.Error("Should have ordered identical keys by hash alone")
+	}
+}
+
+func TestGetAllWithTTL(t *testing.T) {
+	c := NewExpiresAfterWriteCache(time.Minute).(*PowerCache)
+	c.Put("a", "a")
+	c.PutWithTTL("b", "b", time.Second*10)
+	c.PutWithTTL("c", "c", time.Millisecond)
+	time.Sleep(time.Millisecond * 5)
+
+	got := c.GetAllWithTTL([]string{"a", "b", "c", "d"})
+	if len(got) != 2 {
+		t.Error("Should have only returned a and b, got", got)
+	}
+	if v := got["a"]; v.Value != "a" || v.TTL <= time.Second*50 || v.TTL > time.Minute {
+		t.Error("Should have returned a with about a minute left, got", v)
+	}
+	if v := got["b"]; v.Value != "b" || v.TTL <= 0 || v.TTL > time.Second*10 {
+		t.Error("Should have returned b with its own ttl, got", v)
+	}
+	if c.Length() != 2 {
+		t.Error("Should have evicted the expired key, got", c.Length())
+	}
+	if c.RequestCount() != 4 || c.HitCount() != 2 {
+		t.Error("Should have counted each key as a request, got", c.RequestCount(), c.HitCount())
+	}
+}
+
+func TestPin(t *testing.T) {
+	c := new(PowerCache)
+	c.MaxKeys = 3
+	c.ExpiresAfterWriteDuration = time.Millisecond * 20
+	c.Initialize()
+
+	c.Put("config", "v1")
+	c.Pin("config")
+	time.Sleep(time.Millisecond * 2)
+	for _, k := range []string{"a", "b", "c", "d"} {
+		c.Put(k, k)
+	}
+	c.CleanUp()
+	if _, err := c.GetIfPresent("config"); err != nil {
+		t.Error("Should have kept the pinned key through size eviction")
+	}
+	if _, err := c.GetIfPresent("a"); err != ErrNotPresent {
+		t.Error("Should have evicted unpinned keys instead")
+	}
+	checkConsistent(t, c)
+
+	time.Sleep(time.Millisecond * 30)
+	c.CleanUp()
+	if _, err := c.GetIfPresent("config"); err != nil {
+		t.Error("Should have kept the pinned key past its expiry")
+	}
+	if _, ttl, _ := c.GetWithTTL("config"); ttl != NoExpiration {
+		t.Error("Should not report a ttl for a pinned key, got", ttl)
+	}
+
+	c.Put("config", "v2")
+	if v, _ := c.GetIfPresent("config"); v != "v2" {
+		t.Error("Should have replaced the pinned value, got", v)
+	}
+	c.Unpin("config")
+	time.Sleep(time.Millisecond * 30)
+	if _, err := c.GetIfPresent("config"); err != ErrNotPresent {
+		t.Error("Should have expired once unpinned")
+	}
+
+	c.Put("config", "v3")
+	c.Pin("config")
+	c.Invalidate("config")
+	if _, err := c.GetIfPresent("config"); err != ErrNotPresent {
+		t.Error("Should have invalidated the pinned key")
+	}
+	checkConsistent(t, c)
+}
+
+func TestSizer(t *testing.T) {
+	c := new(PowerCache)
+	c.MaxSize = 10
+	c.Sizer = func(key string, value interface{}) int64 {
+		return int64(len(value.([]byte)))
+	}
+	c.Initialize()
+
+	c.Put("a", []byte("aaaa"))
+	c.Put("b", []byte("bb"))
+	if c.Size() != 6 {
+		t.Error("Should have measured 6 bytes, got", c.Size())
+	}
+	c.Put("b", []byte("bbbb"))
+	if c.Size() != 8 {
+		t.Error("Should have replaced b's size, got", c.Size())
+	}
+	c.Put("c", []byte("cccc"))
+	if c.Size() != 12 {
+		t.Error("Should have gone over MaxSize before cleaning, got", c.Size())
+	}
+	c.Put("d", []byte("d"))
+	if c.Size() != 9 || c.Length() != 3 {
+		t.Error("Should have evicted by bytes to get back under MaxSize, got", c.Size(), c.Length())
+	}
+	if _, err := c.GetIfPresent("a"); err != ErrNotPresent {
+		t.Error("Should have evicted the oldest value")
+	}
+	c.Invalidate("d")
+	if c.Size() != 8 {
+		t.Error("Should have subtracted the invalidated value, got", c.Size())
+	}
+	c.InvalidateAll()
+	if c.Size() != 0 {
+		t.Error("Should have reset the size, got", c.Size())
+	}
+}
+
+func TestCloneFunc(t *testing.T) {
+	c := NewPowerCache()
+	c.CloneFunc = func(value interface{}) interface{} {
+		return append([]int(nil), value.([]int)...)
+	}
+
+	orig := []int{1, 2, 3}
+	c.Put("a", orig)
+	orig[0] = 100
+	v, _ := c.GetIfPresent("a")
+	if v.([]int)[0] != 1 {
+		t.Error("Should have stored a copy of the put value, got", v)
+	}
+	v.([]int)[1] = 200
+	v, _ = c.GetIfPresent("a")
+	if v.([]int)[1] != 2 {
+		t.Error("Should have handed out a copy on read, got", v)
+	}
+
+	p := NewPowerCache()
+	p.Put("a", []int{1})
+	v, _ = p.GetIfPresent("a")
+	v.([]int)[0] = 2
+	if v, _ = p.GetIfPresent("a"); v.([]int)[0] != 2 {
+		t.Error("Should share values when there is no CloneFunc")
+	}
+}
+
+func TestRefreshInterval(t *testing.T) {
+	c := NewPowerCache()
+	var mu sync.Mutex
+	loads := make(map[string]int)
+	c.ValueLoader = func(key string) (interface{}, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		loads[key]++
+		return key, nil
+	}
+	c.Put("a", "a")
+	c.Put("b", "b")
+
+	//A fake clock, each tick is only taken once the last refresh is done
+	ticks := make(chan time.Time)
+	stopped := false
+	c.startRefresher(ticks, func() { stopped = true })
+	ticks <- time.Now()
+	ticks <- time.Now()
+	c.Close()
+
+	mu.Lock()
+	if loads["a"] != 2 || loads["b"] != 2 {
+		t.Error("Should have refreshed every key on each tick, got", loads)
+	}
+	mu.Unlock()
+	if !stopped {
+		t.Error("Should have stopped the ticker on Close")
+	}
+	c.Close()
+
+	r := new(PowerCache)
+	r.RefreshInterval = time.Millisecond
+	r.ValueLoader = c.ValueLoader
+	r.Initialize()
+	r.Put("c", "c")
+	time.Sleep(time.Millisecond * 10)
+	r.Close()
+	mu.Lock()
+	if loads["c"] == 0 {
+		t.Error("Should have refreshed c in the background")
+	}
+	mu.Unlock()
+}
+
+func TestLoadFromReaderLimitsAndListener(t *testing.T) {
+	c := NewPowerCache()
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		c.Put(k, k+"2")
+	}
+	var buf bytes.Buffer
+	if err := c.SaveToWriter(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	d := new(PowerCache)
+	d.MaxKeys = 3
+	d.Initialize()
+	d.Put("a", "a1")
+	replaced := 0
+	d.RemovalListener = func(key string, value interface{}, cause RemovalCause) {
+		if cause == Replaced {
+			replaced++
+			if key != "a" || value != "a1" {
+				t.Error("Should have replaced the old a, got", key, value)
+			}
+		}
+	}
+	if err := d.LoadFromReader(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if replaced != 1 {
+		t.Error("Should have told the listener a was replaced, got", replaced)
+	}
+	if d.Length() >= 3 {
+		t.Error("Should have evicted back under MaxKeys, got", d.Length())
+	}
+	checkConsistent(t, d)
+}
+
+func TestEvictionOrderDoesNotGoStale(t *testing.T) {
+	c := new(PowerCache)
+	c.MaxKeys = 3
+	c.Initialize()
+	c.Put("heavy", "heavy")
+	c.SetWeight("heavy", 10)
+	time.Sleep(time.Millisecond * 5)
+	c.Put("light", "light")
+	time.Sleep(time.Millisecond * 20)
+	c.Put("x", "x")
+	c.SetWeight("x", 5)
+
+	c.Put("y", "y")
+	if _, err := c.GetIfPresent("light"); err != ErrNotPresent {
+		t.Error("Should have evicted the light key")
+	}
+	if _, err := c.GetIfPresent("heavy"); err != nil {
+		t.Error("Should have kept the heavy key")
+	}
+
+	//Age a bigger cache with mixed weights, the heap top must match a full scan
+	r := rand.New(rand.NewSource(7))
+	c = NewPowerCache()
+	for i := 0; i < 200; i++ {
+		k := fmt.Sprint(i)
+		c.Put(k, i)
+		c.SetWeight(k, r.Int63n(10))
+		if i%7 == 0 {
+			c.GetIfPresent(fmt.Sprint(r.Intn(i + 1)))
+		}
+	}
+	c.MaxKeys = 150
+	for i := 0; i < 100; i++ {
+		time.Sleep(time.Microsecond * 50)
+		c.Put(fmt.Sprint("new", i), i)
+		c.SetWeight(fmt.Sprint("new", i), r.Int63n(10))
+
+		c.mu.RLock()
+		top, _ := c.findVictim()
+		scanned, _ := c.scanVictim()
+		c.mu.RUnlock()
+		if top != scanned {
+			t.Error("Should have picked the same victim as a full scan, got", top, "and", scanned)
+			break
+		}
+	}
+	checkConsistent(t, c)
+}
+
+func TestNegativeCachingIsBounded(t *testing.T) {
+	c := NewPowerCache()
+	c.NegativeTTL = time.Millisecond
+	c.ValueLoader = func(key string) (interface{}, error) {
+		return nil, ErrNotFound
+	}
+	for i := 0; i < 1000; i++ {
+		c.Get(fmt.Sprint(i))
+	}
+	time.Sleep(time.Millisecond * 3)
+	c.Get("another")
+	c.mu.RLock()
+	n := len(c.negative)
+	c.mu.RUnlock()
+	if n != 1 {
+		t.Error("Should have swept out the lapsed negative entries, got", n)
+	}
+
+	//CleanUp looks at no more than MaxCleanUpScan of them
+	c.MaxCleanUpScan = 10
+	c.mu.Lock()
+	c.negative = make(map[string]time.Time)
+	for i := 0; i < 100; i++ {
+		c.negative[fmt.Sprint("more", i)] = time.Now().Add(-time.Second)
+	}
+	c.mu.Unlock()
+	c.CleanUp()
+	c.mu.RLock()
+	n = len(c.negative)
+	c.mu.RUnlock()
+	if n != 90 {
+		t.Error("Should have only swept MaxCleanUpScan negative entries, got", n)
+	}
+}
+
+func TestNegativeCachingWrappedNotFound(t *testing.T) {
+	c := NewPowerCache()
+	c.NegativeTTL = time.Minute
+	loads := 0
+	c.ValueLoader = func(key string) (interface{}, error) {
+		loads++
+		return nil, fmt.Errorf("db: %w", ErrNotFound)
+	}
+	c.Get("a")
+	if _, err := c.Get("a"); !errors.Is(err, ErrNotFound) {
+		t.Error("Should have remembered a wrapped ErrNotFound, got", err)
+	}
+	if loads != 1 {
+		t.Error("Should have only loaded once, got", loads)
+	}
+}
+
+func TestGetWithTTLRacingInvalidate(t *testing.T) {
+	c := NewExpiresAfterWriteCache(time.Minute).(*PowerCache)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2000; i++ {
+			c.Put("a", "a")
+			c.Invalidate("a")
+		}
+	}()
+	for i := 0; i < 2000; i++ {
+		if _, ttl, err := c.GetWithTTL("a"); err == nil && (ttl <= 0 || ttl > time.Minute) {
+			t.Error("Should never see a value with a bogus ttl, got", ttl)
+			break
+		}
+	}
+	wg.Wait()
+}
+
+func TestPutAllOverMaxKeys(t *testing.T) {
+	c := NewMaxKeysCache(3).(*PowerCache)
+	values := make(map[string]interface{})
+	for i := 0; i < 10; i++ {
+		values[fmt.Sprint(i)] = i
+	}
+	c.PutAll(values)
+	if c.Length() > 3 {
+		t.Error("Should have evicted back under MaxKeys, got", c.Length())
+	}
+	checkConsistent(t, c)
+}
+
+func TestErrorTTL(t *testing.T) {
+	c := NewPowerCache()
+	c.ErrorTTL = time.Millisecond * 20
+	backendDown := errors.New("backend down")
+	loads := 0
+	c.ValueLoader = func(key string) (interface{}, error) {
+		loads++
+		if loads == 1 {
+			return nil, backendDown
+		}
+		return key, nil
+	}
+
+	if _, err := c.Get("a"); !errors.Is(err, backendDown) {
+		t.Error("Should have returned the loader's error, got", err)
+	}
+	if _, err := c.Get("a"); !errors.Is(err, backendDown) {
+		t.Error("Should have returned the cached error, got", err)
+	}
+	if _, err := c.GetIfPresent("a"); !errors.Is(err, backendDown) {
+		t.Error("Should have returned the cached error on GetIfPresent, got", err)
+	}
+	if loads != 1 {
+		t.Error("Should not have loaded again within ErrorTTL, got", loads)
+	}
+	if c.HitCount() != 0 {
+		t.Error("Should not count a cached error as a hit")
+	}
+
+	time.Sleep(time.Millisecond * 30)
+	if v, err := c.Get("a"); err != nil || v != "a" {
+		t.Error("Should have retried once ErrorTTL passed, got", v, err)
+	}
+	if loads != 2 {
+		t.Error("Should have loaded again, got", loads)
+	}
+}
+
+type snapshotValue struct {
+	N int
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	c := NewExpiresAfterWriteCache(time.Minute).(*PowerCache)
+	c.Put("a", &snapshotValue{1})
+	c.PutWithTTL("b", "b", time.Second*10)
+	c.SetWeight("b", 4)
+
+	state := c.Snapshot()
+	if state.Len() != 2 {
+		t.Error("Should have snapshotted both entries, got", state.Len())
+	}
+	c.Put("a", &snapshotValue{2})
+	c.Invalidate("b")
+	c.Put("c", "c")
+
+	d := NewExpiresAfterWriteCache(time.Minute).(*PowerCache)
+	d.Restore(state)
+	if d.Length() != 2 {
+		t.Error("Should have restored the snapshot's entries, got", d.Length())
+	}
+	if v, err := d.GetIfPresent("a"); err != nil || v.(*snapshotValue).N != 1 {
+		t.Error("Should have restored a's value as of the snapshot, got", v, err)
+	}
+	if _, err := d.GetIfPresent("c"); err != ErrNotPresent {
+		t.Error("Should not have restored anything put after the snapshot")
+	}
+	if w, _ := d.WeightOf("b"); w != 4 {
+		t.Error("Should have kept b's weight, got", w)
+	}
+	if _, ttl, _ := d.GetWithTTL("b"); ttl <= time.Second*9 || ttl > time.Second*10 {
+		t.Error("Should have kept b's ttl, got", ttl)
+	}
+	checkConsistent(t, d)
+}
+
+func TestTopKeys(t *testing.T) {
+	c := NewPowerCache()
+	c.TrackKeyStats = true
+	c.Put("hot", "hot")
+	c.Put("warm", "warm")
+	for i := 0; i < 5; i++ {
+		c.GetIfPresent("hot")
+	}
+	for i := 0; i < 3; i++ {
+		c.GetIfPresent("missing")
+	}
+	c.GetIfPresent("warm")
+
+	top := c.TopKeys(2)
+	if len(top) != 2 {
+		t.Fatal("Should have returned 2 keys, got", top)
+	}
+	if top[0] != (KeyStat{"hot", 5, 0}) {
+		t.Error("Should have ranked hot first, got", top[0])
+	}
+	if top[1] != (KeyStat{"missing", 0, 3}) {
+		t.Error("Should have ranked the missing key second, got", top[1])
+	}
+	if all := c.TopKeys(10); len(all) != 3 {
+		t.Error("Should have returned every tracked key, got", all)
+	}
+
+	c.ResetStats()
+	if len(c.TopKeys(10)) != 0 {
+		t.Error("Should have forgotten the per key stats on reset")
+	}
+
+	p := NewPowerCache()
+	p.GetIfPresent("a")
+	if len(p.TopKeys(10)) != 0 {
+		t.Error("Should not track keys unless asked to")
+	}
+}
+
+func TestMaxIdle(t *testing.T) {
+	c := new(PowerCache)
+	c.MaxIdle = time.Millisecond * 40
+	c.ValueLoader = func(key string) (interface{}, error) {
+		return key, nil
+	}
+	c.Initialize()
+	c.Put("idle", "idle")
+	c.Put("read", "read")
+
+	//Keep refreshing both keys but only ever read one of them
+	ticks := make(chan time.Time)
+	c.startRefresher(ticks, func() {})
+	for i := 0; i < 12; i++ {
+		ticks <- time.Now()
+		c.GetIfPresent("read")
+		time.Sleep(time.Millisecond * 5)
+	}
+	c.Close()
+
+	if _, err := c.GetIfPresent("idle"); err != ErrNotPresent {
+		t.Error("Should have evicted the unread key even though it was being refreshed")
+	}
+	if _, err := c.GetIfPresent("read"); err != nil {
+		t.Error("Should have kept the key that was being read")
+	}
+	checkConsistent(t, c)
+}
+
+func TestRange(t *testing.T) {
+	c := NewPowerCache()
+	for i := 0; i < 10; i++ {
+		c.Put(fmt.Sprint(i), i)
+	}
+
+	seen := make(map[string]interface{})
+	c.Range(func(key string, value interface{}) bool {
+		seen[key] = value
+		return true
+	})
+	if len(seen) != 10 || seen["3"] != 3 {
+		t.Error("Should have visited every entry, got", seen)
+	}
+
+	visits := 0
+	c.Range(func(key string, value interface{}) bool {
+		visits++
+		return visits < 3
+	})
+	if visits != 3 {
+		t.Error("Should have stopped once the visitor returned false, got", visits)
+	}
+
+	//The visitor can change the cache as it goes
+	c.Range(func(key string, value interface{}) bool {
+		c.Invalidate(key)
+		c.Put("new"+key, value)
+		return true
+	})
+	if c.Length() != 10 {
+		t.Error("Should have only visited the original entries, got", c.Length())
+	}
+	if c.RequestCount() != 0 {
+		t.Error("Should not have counted requests")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			c.Put(fmt.Sprint(i%20), i)
+			c.Invalidate(fmt.Sprint((i + 10) % 20))
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		c.Range(func(key string, value interface{}) bool {
+			return true
+		})
+	}
+	wg.Wait()
+}
+
+func TestAverageLoadPenaltyConcurrent(t *testing.T) {
+	c := NewPowerCache()
+	c.ValueLoader = func(key string) (interface{}, error) {
+		time.Sleep(time.Millisecond * 5)
+		return key, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.Get(fmt.Sprint(i))
+			c.AverageLoadPenalty()
+		}(i)
+	}
+	wg.Wait()
+
+	if c.LoadSuccessCount() != 50 {
+		t.Error("Should have counted every load, got", c.LoadSuccessCount())
+	}
+	if avg := c.AverageLoadPenalty(); avg < time.Millisecond*5 || avg > time.Millisecond*25 {
+		t.Error("Should have averaged close to the loader's 5ms, got", avg)
+	}
+}
+
+func TestWeightOf(t *testing.T) {
+	c := new(PowerCache)
+	c.DefaultValueWeight = 3
+	c.Initialize()
+	c.Put("a", "a")
+	if w, ok := c.WeightOf("a"); !ok || w != 3 {
+		t.Error("Should have the default weight, got", w, ok)
+	}
+	c.SetWeight("a", 7)
+	if w, _ := c.WeightOf("a"); w != 7 {
+		t.Error("Should have the updated weight, got", w)
+	}
+	if _, ok := c.WeightOf("b"); ok {
+		t.Error("Should not have found b")
+	}
+}
+
+func TestNewCacheOptions(t *testing.T) {
+	evicted := 0
+	c, err := NewCache(
+		WithMaxKeys(2),
+		WithExpireAfterWrite(time.Minute),
+		WithLoader(fetchFunc),
+		WithWeigher(func(key string, value interface{}) int64 { return 2 }),
+		WithRemovalListener(func(key string, value interface{}, cause RemovalCause) { evicted++ }),
+	)
+	if err != nil {
+		t.Fatal("Should have built the cache, got", err)
+	}
+	//Usable straight away without calling Initialize
+	if v, err := c.Get("a"); err != nil || v != 0 {
+		t.Error("Should have loaded a, got", v, err)
+	}
+	c.Put("b", "b")
+	c.Put("c", "c")
+	if evicted == 0 {
+		t.Error("Should have evicted through the listener")
+	}
+	if w, _ := c.WeightOf("c"); w != 2 {
+		t.Error("Should have used the weigher, got", w)
+	}
+	if c.PeriodicMaintenance == 0 {
+		t.Error("Should have set up maintenance for an expiring cache")
+	}
+
+	if _, err := NewCache(WithMaxKeys(2), WithMaxKeys(3)); err != ErrOptionConflict {
+		t.Error("Should have rejected conflicting max keys, got", err)
+	}
+	if _, err := NewCache(WithLoader(fetchFunc), WithLoader(fetchFunc)); err != ErrOptionConflict {
+		t.Error("Should have rejected two loaders, got", err)
+	}
+	if _, err := NewCache(WithAdmissionFilter()); err != ErrOptionConflict {
+		t.Error("Should have rejected an admission filter without max keys, got", err)
+	}
+	if _, err := NewCache(WithExpireAfterAccess(-time.Second)); err != ErrInvalidOption {
+		t.Error("Should have rejected a negative duration, got", err)
+	}
+	if _, err := NewCache(WithMaxKeys(2), WithMaxKeys(2)); err != nil {
+		t.Error("Should allow repeating an option with the same value, got", err)
+	}
+}
+
+func TestZeroValuePowerCache(t *testing.T) {
+	var c PowerCache
+	c.MaxKeys = 2
+	c.Put("a", "a")
+	if v, err := c.GetIfPresent("a"); err != nil || v != "a" {
+		t.Error("Should have worked without Initialize, got", v, err)
+	}
+	if w, _ := c.WeightOf("a"); w != 1 {
+		t.Error("Should have used the default weight, got", w)
+	}
+	c.Put("b", "b")
+	c.Put("c", "c")
+	if c.Length() > 2 {
+		t.Error("Should have kept to MaxKeys, got", c.Length())
+	}
+
+	var l PowerCache
+	l.ValueLoader = fetchFunc
+	if _, err := l.Get("a"); err != nil {
+		t.Error("Should have loaded without Initialize, got", err)
+	}
+	var g PowerCache
+	if _, err := g.GetIfPresent("a"); err != ErrNotPresent {
+		t.Error("Should have missed on an empty zero value cache, got", err)
+	}
+	g.InvalidateAll()
+	g.CleanUp()
+	g.Invalidate("a")
+
+	//Flushing first mustn't skip the rest of Initialize
+	var f PowerCache
+	f.InvalidateAll()
+	f.Put("a", 1)
+	if w, _ := f.WeightOf("a"); w != 1 {
+		t.Error("Should have used the default weight after a flush, got", w)
+	}
+}
+
+func TestReplaceIfPresent(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Millisecond * 50
+	var causes []RemovalCause
+	c.RemovalListener = func(key string, value interface{}, cause RemovalCause) {
+		causes = append(causes, cause)
+	}
+	if c.ReplaceIfPresent("a", "a") {
+		t.Error("Should not have replaced a missing key")
+	}
+	if _, err := c.GetIfPresent("a"); err != ErrNotPresent {
+		t.Error("Should not have populated a missing key, got", err)
+	}
+
+	c.Put("a", "a")
+	time.Sleep(time.Millisecond * 30)
+	if !c.ReplaceIfPresent("a", "b") {
+		t.Error("Should have replaced a present key")
+	}
+	//The replace restarted the write expiry
+	time.Sleep(time.Millisecond * 30)
+	if v, err := c.GetIfPresent("a"); err != nil || v != "b" {
+		t.Error("Should have kept the replaced value, got", v, err)
+	}
+
+	time.Sleep(time.Millisecond * 60)
+	if c.ReplaceIfPresent("a", "c") {
+		t.Error("Should not have replaced an expired key")
+	}
+	if c.Length() != 0 {
+		t.Error("Should have removed the expired key, got", c.Length())
+	}
+	if len(causes) != 2 || causes[0] != Replaced || causes[1] != Expired {
+		t.Error("Should have been told about the replace and the expiry, got", causes)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	c := NewPowerCache()
+	if c.CompareAndSwap("a", nil, "a") {
+		t.Error("Should not have swapped a missing key")
+	}
+	if c.Length() != 0 {
+		t.Error("Should not have populated a missing key, got", c.Length())
+	}
+
+	c.Put("a", []int{1, 2})
+	if c.CompareAndSwap("a", []int{1, 3}, []int{2}) {
+		t.Error("Should not have swapped a different value")
+	}
+	if v, _ := c.GetIfPresent("a"); len(v.([]int)) != 2 {
+		t.Error("Should have kept the value on a mismatch, got", v)
+	}
+	if !c.CompareAndSwap("a", []int{1, 2}, []int{2}) {
+		t.Error("Should have swapped an equal value")
+	}
+	if v, _ := c.GetIfPresent("a"); len(v.([]int)) != 1 {
+		t.Error("Should have stored the new value, got", v)
+	}
+	//The old value is gone, so swapping from it again fails
+	if c.CompareAndSwap("a", []int{1, 2}, []int{3}) {
+		t.Error("Should not have swapped from a stale value")
+	}
+}
+
+func TestRefreshDoesNotCountAsRequests(t *testing.T) {
+	c := NewPowerCache()
+	c.ValueLoader = func(key string) (interface{}, error) {
+		return key, nil
+	}
+	c.Put("a", "a")
+	c.Put("b", "b")
+	c.GetIfPresent("a")
+	c.GetIfPresent("c")
+	if c.RequestCount() != 2 || c.HitRate() != 0.5 {
+		t.Error("Should have counted the user reads, got", c.RequestCount(), c.HitRate())
+	}
+
+	c.Refresh("a")
+	c.RefreshAll([]string{"a", "b", "c"}, 2)
+	ticks := make(chan time.Time)
+	c.startRefresher(ticks, func() {})
+	ticks <- time.Now()
+	c.Close()
+	if c.RequestCount() != 2 || c.HitRate() != 0.5 {
+		t.Error("Should not have counted refreshes as requests, got", c.RequestCount(), c.HitRate())
+	}
+	if c.LoadCount() != 7 {
+		t.Error("Should still have counted the refreshes as loads, got", c.LoadCount())
+	}
+
+	c.GetIfPresent("c")
+	if c.RequestCount() != 3 || c.HitCount() != 2 {
+		t.Error("Should have counted the refreshed key being read, got", c.RequestCount(), c.HitCount())
+	}
+}
+
+func TestEvictionTiesAreBrokenByHash(t *testing.T) {
+	run := func(comparer Comparer) []string {
+		c := NewPowerCache()
+		c.Comparer = comparer
+		var victims []string
+		c.RemovalListener = func(key string, value interface{}, cause RemovalCause) {
+			victims = append(victims, key)
+		}
+		for i := 0; i < 100; i++ {
+			c.Put(fmt.Sprint(i), i)
+		}
+		//Make every key look exactly alike
+		now := time.Now()
+		for k := range c.values {
+			c.atime[k] = now
+			c.evict.track(k)
+		}
+		c.MaxKeys = 91
+		c.CleanUp()
+		return victims
+	}
+
+	victims := run(nil)
+	if len(victims) != 10 {
+		t.Fatal("Should have evicted 10 keys, got", victims)
+	}
+	for i := 1; i < len(victims); i++ {
+		if keyHash(victims[i-1]) > keyHash(victims[i]) {
+			t.Error("Should have evicted tied keys lowest hash first, got", victims)
+		}
+	}
+	for i, v := range run(nil) {
+		if victims[i] != v {
+			t.Error("Should have evicted the same keys every time, got", victims, "then", v, "at", i)
+		}
+	}
+	//The victims shouldn't all come from one end of the keys
+	low, high := 0, 0
+	for _, v := range victims {
+		var n int
+		fmt.Sscan(v, &n)
+		if n < 50 {
+			low++
+		} else {
+			high++
+		}
+	}
+	if low == 0 || high == 0 {
+		t.Error("Should have spread the victims over the keys, got", victims)
+	}
+
+	byWeight := func(aWeight, bWeight int64, aAge, bAge time.Duration) int64 {
+		return aWeight - bWeight
+	}
+	for i, v := range run(byWeight) {
+		if victims[i] != v {
+			t.Error("Should have broken a Comparer's ties the same way, got", v, "at", i)
+		}
+	}
+}
+
+func TestForceCleanUp(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Millisecond * 20
+	c.PeriodicMaintenance = time.Hour
+	c.Initialize()
+	for i := 0; i < 10; i++ {
+		c.Put(fmt.Sprint(i), i)
+	}
+	time.Sleep(time.Millisecond * 30)
+
+	//Maintenance isn't due for an hour, so a Put leaves the expired keys be
+	c.Put("a", "a")
+	if c.Length() != 11 {
+		t.Error("Should not have cleaned up before maintenance was due, got", c.Length())
+	}
+	c.nextClean = time.Now().Add(-time.Millisecond)
+	c.Put("b", "b")
+	if c.Length() != 2 {
+		t.Error("Should have cleaned up once maintenance was due, got", c.Length())
+	}
+	if !c.nextClean.After(time.Now()) {
+		t.Error("Should have scheduled the next maintenance")
+	}
+
+	c.MaxCleanUpScan = 1
+	for i := 0; i < 10; i++ {
+		c.Put(fmt.Sprint(i), i)
+	}
+	time.Sleep(time.Millisecond * 30)
+	c.ForceCleanUp()
+	if c.Length() != 0 {
+		t.Error("Should have swept every expired key despite MaxCleanUpScan, got", c.Length())
+	}
+	checkConsistent(t, c)
+}
+
+func TestBytesCache(t *testing.T) {
+	p := NewPowerCache()
+	p.MaxKeys = 3
+	removed := make(map[string][]byte)
+	p.RemovalListener = func(key string, value interface{}, cause RemovalCause) {
+		removed[key] = value.([]byte)
+	}
+	c := NewBytesCache(p)
+	for _, k := range []string{"a", "b", "c"} {
+		c.Put(k, []byte(k))
+		time.Sleep(time.Millisecond * 2)
+	}
+	if v, err := c.GetIfPresent("b"); err != nil || string(v) != "b" {
+		t.Error("Should have returned the bytes, got", v, err)
+	}
+	if _, err := c.GetIfPresent("x"); err != ErrNotPresent {
+		t.Error("Should have missed on a missing key, got", err)
+	}
+	if p.HitCount() != 1 || p.MissCount() != 1 {
+		t.Error("Should have counted the reads on the PowerCache, got", p.HitCount(), p.MissCount())
+	}
+
+	c.Put("d", []byte("d"))
+	if string(removed["a"]) != "a" {
+		t.Error("Should have evicted a and passed its bytes to the listener, got", removed)
+	}
+	if len(c.values) != c.Length() || c.Length() > 3 {
+		t.Error("Should have dropped the bytes of evicted keys, got", len(c.values), c.Length())
+	}
+	c.Invalidate("b")
+	if _, ok := c.values["b"]; ok {
+		t.Error("Should have dropped the bytes of an invalidated key")
+	}
+	p.InvalidateAll()
+	if len(c.values) != 0 {
+		t.Error("Should have dropped every value, got", len(c.values))
+	}
+	checkConsistent(t, p)
+
+	s := NewStringCache(NewExpiresAfterWriteCache(time.Millisecond * 10).(*PowerCache))
+	s.Put("a", "a")
+	if v, err := s.GetIfPresent("a"); err != nil || v != "a" {
+		t.Error("Should have returned the string, got", v, err)
+	}
+	time.Sleep(time.Millisecond * 20)
+	if _, err := s.GetIfPresent("a"); err != ErrNotPresent {
+		t.Error("Should have expired the string, got", err)
+	}
+	if len(s.values) != 0 {
+		t.Error("Should have dropped the expired string")
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Millisecond * 10
+	var mu sync.Mutex
+	loads := make(map[string]int)
+	c.ValueLoader = func(key string) (interface{}, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		loads[key]++
+		if key == "bad" {
+			return nil, errors.New("bad")
+		}
+		return "loaded", nil
+	}
+	c.Put("a", "a")
+	c.Put("old", "old")
+	time.Sleep(time.Millisecond * 20)
+	c.Put("b", "b")
+
+	errs := c.WarmUp([]string{"a", "b", "c", "old", "bad"})
+	if len(errs) != 1 || errs["bad"] == nil {
+		t.Error("Should have returned the failed key, got", errs)
+	}
+	if loads["b"] != 0 {
+		t.Error("Should not have reloaded a present key, got", loads)
+	}
+	if loads["a"] != 1 || loads["c"] != 1 || loads["old"] != 1 {
+		t.Error("Should have loaded the missing and expired keys, got", loads)
+	}
+	if v, _ := c.GetIfPresent("b"); v != "b" {
+		t.Error("Should have kept the present value, got", v)
+	}
+	if v, _ := c.GetIfPresent("c"); v != "loaded" {
+		t.Error("Should have cached the warmed value, got", v)
+	}
+	if c.RequestCount() != 2 {
+		t.Error("Should not have counted the warm up as requests, got", c.RequestCount())
+	}
+}
+
+func TestEvictBatchSize(t *testing.T) {
+	c := NewPowerCache()
+	c.MaxKeys = 10
+	c.EvictBatchSize = 4
+	for i := 0; i < 10; i++ {
+		c.Put(fmt.Sprint(i), i)
+	}
+	if c.EvictionCount() != 0 {
+		t.Error("Should not have evicted before reaching MaxKeys, got", c.EvictionCount())
+	}
+	c.Put("a", "a")
+	if c.EvictionCount() != 4 || c.Length() != 7 {
+		t.Error("Should have evicted a whole batch, got", c.EvictionCount(), c.Length())
+	}
+	//The headroom takes the next few puts without evicting
+	c.Put("b", "b")
+	c.Put("c", "c")
+	c.Put("d", "d")
+	if c.EvictionCount() != 4 || c.Length() != 10 {
+		t.Error("Should have used the headroom, got", c.EvictionCount(), c.Length())
+	}
+	for _, k := range []string{"0", "1", "2", "3"} {
+		if _, err := c.GetIfPresent(k); err != ErrNotPresent {
+			t.Error("Should have evicted the oldest keys first, kept", k)
+		}
+	}
+	checkConsistent(t, c)
+}
+
+func TestPutWithMeta(t *testing.T) {
+	c := NewPowerCache()
+	c.MaxKeys = 2
+	c.PutWithMeta("a", "a", "db")
+	v, meta, err := c.GetWithMeta("a")
+	if err != nil || v != "a" || meta != "db" {
+		t.Error("Should have returned the value and its metadata, got", v, meta, err)
+	}
+	if _, meta, _ := c.GetWithMeta("missing"); meta != nil {
+		t.Error("Should not have metadata for a missing key, got", meta)
+	}
+
+	var b bytes.Buffer
+	if err := c.SaveToWriter(&b); err != nil {
+		t.Fatal(err)
+	}
+	d := NewPowerCache()
+	if err := d.LoadFromReader(&b); err != nil {
+		t.Fatal(err)
+	}
+	if _, meta, _ := d.GetWithMeta("a"); meta != "db" {
+		t.Error("Should have kept the metadata through a save, got", meta)
+	}
+	d.Restore(c.Snapshot())
+	if _, meta, _ := d.GetWithMeta("a"); meta != "db" {
+		t.Error("Should have kept the metadata through a snapshot, got", meta)
+	}
+
+	c.Put("a", "b")
+	if _, meta, _ := c.GetWithMeta("a"); meta != nil {
+		t.Error("Should have dropped the metadata of the old value, got", meta)
+	}
+	c.PutWithMeta("a", "a", 1)
+	c.Invalidate("a")
+	if len(c.meta) != 0 {
+		t.Error("Should have dropped the metadata on Invalidate, got", c.meta)
+	}
+	c.PutWithMeta("b", "b", 2)
+	c.PutWithMeta("c", "c", 3)
+	c.PutWithMeta("d", "d", 4)
+	if len(c.meta) != c.Length() {
+		t.Error("Should have dropped the metadata of evicted keys, got", c.meta)
+	}
+	c.InvalidateAll()
+	if len(c.meta) != 0 {
+		t.Error("Should have dropped every key's metadata, got", c.meta)
+	}
+}
+
+func TestCleanUpKeepsKeysPutDuringScan(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Millisecond * 10
+	c.Put("a", "a")
+	c.Put("b", "b")
+	time.Sleep(time.Millisecond * 20)
+
+	//Put a again between the scan and the sweep
+	expired, _ := c.expiredKeys(0)
+	if len(expired) != 2 {
+		t.Fatal("Should have found both keys expired, got", expired)
+	}
+	c.Put("a", "fresh")
+	c.mu.Lock()
+	removed, count := c.sweepExpired(expired, time.Now(), 0, nil)
+	c.mu.Unlock()
+	c.notify(removed)
+	if count != 1 {
+		t.Error("Should only have swept b, got", count)
+	}
+	if v, err := c.GetIfPresent("a"); err != nil || v != "fresh" {
+		t.Error("Should have kept the key put during the scan, got", v, err)
+	}
+
+	//The same race for real, every key is put again while CleanUp runs so
+	//each one ends up fresh whichever got to it first
+	r := NewPowerCache()
+	r.ExpiresAfterWriteDuration = time.Second
+	for i := 0; i < 1000; i++ {
+		r.Put(fmt.Sprint(i), i)
+	}
+	r.mu.Lock()
+	for k := range r.values {
+		r.wtime[k] = r.wtime[k].Add(-time.Hour)
+	}
+	r.mu.Unlock()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			r.Put(fmt.Sprint(i), "fresh")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			r.CleanUp()
+		}
+	}()
+	wg.Wait()
+	for i := 0; i < 1000; i++ {
+		if v, err := r.GetIfPresent(fmt.Sprint(i)); err != nil || v != "fresh" {
+			t.Error("Should not have evicted", i, "after it was put again, got", v, err)
+		}
+	}
+	checkConsistent(t, r)
+	checkConsistent(t, c)
+}
+
+func TestInvalidateMatching(t *testing.T) {
+	c := NewPowerCache()
+	var removed []string
+	c.RemovalListener = func(key string, value interface{}, cause RemovalCause) {
+		if cause != Explicit {
+			t.Error("Should have removed", key, "explicitly, got", cause)
+		}
+		removed = append(removed, key)
+	}
+	for _, k := range []string{"user:1", "user:2", "order:1", "users"} {
+		c.Put(k, k)
+	}
+	n := c.InvalidateMatching(func(key string) bool {
+		//The cache isn't locked while matching
+		c.Length()
+		return strings.HasPrefix(key, "user:")
+	})
+	if n != 2 || len(removed) != 2 {
+		t.Error("Should have removed both user keys, got", n, removed)
+	}
+	for _, k := range []string{"order:1", "users"} {
+		if _, err := c.GetIfPresent(k); err != nil {
+			t.Error("Should have kept", k)
+		}
+	}
+	if c.InvalidateMatching(func(key string) bool { return false }) != 0 {
+		t.Error("Should not have removed anything")
+	}
+	checkConsistent(t, c)
+}
+
+func TestGetOrLoad(t *testing.T) {
+	c := NewPowerCache()
+	c.NegativeTTL = time.Minute
+	c.ErrorTTL = time.Minute
+	loads := 0
+	failing := func(key string) (interface{}, error) {
+		loads++
+		if key == "missing" {
+			return nil, ErrNotFound
+		}
+		return nil, errors.New("down")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetOrLoad("a", failing); !errors.As(err, new(*LoaderError)) || errors.Unwrap(err).Error() != "down" {
+			t.Error("Should have returned the loader's error, got", err)
+		}
+		if _, err := c.GetOrLoad("missing", failing); !errors.Is(err, ErrNotFound) {
+			t.Error("Should have returned ErrNotFound, got", err)
+		}
+	}
+	if loads != 4 {
+		t.Error("Should have loaded again every time after an error, got", loads)
+	}
+	if c.Length() != 0 || len(c.negative) != 0 || len(c.failed) != 0 {
+		t.Error("Should not have cached anything for the errors")
+	}
+	if _, err := c.GetIfPresent("a"); err != ErrNotPresent {
+		t.Error("Should have left a uncached, got", err)
+	}
+
+	ok := func(key string) (interface{}, error) {
+		loads++
+		return nil, nil
+	}
+	v, err := c.GetOrLoad("a", ok)
+	if err != nil || v != nil {
+		t.Error("Should have loaded a nil value, got", v, err)
+	}
+	if _, err := c.GetOrLoad("a", failing); err != nil {
+		t.Error("Should have returned the cached nil without loading, got", err)
+	}
+	if loads != 5 {
+		t.Error("Should only have loaded a once it succeeded, got", loads)
+	}
+}
+
+func TestAdaptiveMaintenance(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Second
+	c.PeriodicMaintenance = time.Minute
+	c.MinMaintenance = time.Second * 10
+	c.MaxMaintenance = time.Minute * 4
+	c.Initialize()
+
+	//Wind the clock back on every key instead of waiting for them to expire
+	expireAll := func() {
+		c.mu.Lock()
+		for k := range c.values {
+			c.wtime[k] = c.wtime[k].Add(-time.Hour)
+		}
+		c.mu.Unlock()
+	}
+	for _, want := range []time.Duration{time.Second * 30, time.Second * 15, time.Second * 10, time.Second * 10} {
+		for i := 0; i < 10; i++ {
+			c.Put(fmt.Sprint(i), i)
+		}
+		expireAll()
+		c.CleanUp()
+		if c.maintenance != want {
+			t.Error("Should have shortened the interval to", want, "got", c.maintenance)
+		}
+		if until := c.nextClean.Sub(time.Now()); until > want {
+			t.Error("Should have scheduled the next clean within", want, "got", until)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		c.Put(fmt.Sprint(i), i)
+	}
+	for _, want := range []time.Duration{time.Second * 20, time.Second * 40, time.Second * 80, time.Second * 160, time.Minute * 4} {
+		c.CleanUp()
+		if c.maintenance != want {
+			t.Error("Should have lengthened the interval to", want, "got", c.maintenance)
+		}
+	}
+
+	//Without bounds the interval stays put
+	f := NewPowerCache()
+	f.ExpiresAfterWriteDuration = time.Second
+	f.PeriodicMaintenance = time.Minute
+	f.Initialize()
+	f.Put("a", "a")
+	f.CleanUp()
+	if f.maintenance != time.Minute {
+		t.Error("Should have kept PeriodicMaintenance, got", f.maintenance)
+	}
+}
+
+func TestShrink(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Minute
+	for i := 0; i < 100; i++ {
+		c.Put(fmt.Sprint(i), i)
+	}
+	//A fifth of the keys have expired
+	c.mu.Lock()
+	for i := 0; i < 20; i++ {
+		c.wtime[fmt.Sprint(i)] = time.Now().Add(-time.Hour)
+	}
+	c.mu.Unlock()
+	c.GetIfPresent("99")
+
+	if n := c.Shrink(0.5); n != 60 {
+		t.Error("Should have swept the expired keys and half the rest, got", n)
+	}
+	if c.Length() != 40 {
+		t.Error("Should have shrunk the cache, got", c.Length())
+	}
+	if _, err := c.GetIfPresent("99"); err != nil {
+		t.Error("Should have kept the most recently used key")
+	}
+	if n := c.Shrink(0); n != 0 {
+		t.Error("Should not have removed anything live without a fraction, got", n)
+	}
+	if n := c.Shrink(1); n != 40 || c.Length() != 0 {
+		t.Error("Should have emptied the cache, got", n, c.Length())
+	}
+	checkConsistent(t, c)
+}
+
+func TestLengthByExpiry(t *testing.T) {
+	c := NewPowerCache()
+	c.Put("a", "a")
+	if live, stale := c.LengthByExpiry(); live != 1 || stale != 0 {
+		t.Error("Should have counted everything as live without expiry, got", live, stale)
+	}
+
+	c.ExpiresAfterWriteDuration = time.Minute
+	c.Put("b", "b")
+	c.Put("c", "c")
+	c.Put("d", "d")
+	c.Pin("d")
+	c.mu.Lock()
+	for _, k := range []string{"a", "b", "d"} {
+		c.wtime[k] = time.Now().Add(-time.Hour)
+	}
+	c.mu.Unlock()
+	if live, stale := c.LengthByExpiry(); live != 2 || stale != 2 {
+		t.Error("Should have counted a and b as stale, got", live, stale)
+	}
+	c.CleanUp()
+	if live, stale := c.LengthByExpiry(); live != 2 || stale != 0 {
+		t.Error("Should have had nothing stale after a clean up, got", live, stale)
+	}
+}
+
+func TestEvictionFactors(t *testing.T) {
+	run := func(weightFactor, ageFactor float64) map[string]bool {
+		c := NewPowerCache()
+		c.MaxKeys = 3
+		c.WeightFactor = weightFactor
+		c.AgeFactor = ageFactor
+		c.Weigher = func(key string, value interface{}) int64 {
+			if key == "heavy" {
+				return 10
+			}
+			return 1
+		}
+		evicted := make(map[string]bool)
+		c.RemovalListener = func(key string, value interface{}, cause RemovalCause) {
+			evicted[key] = true
+		}
+		c.Initialize()
+		c.Put("heavy", 0)
+		c.Put("light", 0)
+		for i := 0; i < 30; i++ {
+			c.Put(fmt.Sprint(i), i)
+		}
+		checkConsistent(t, c)
+		return evicted
+	}
+
+	ageOnly := run(0, 1)
+	if !ageOnly["heavy"] {
+		t.Error("Should have evicted the oldest key however heavy when only age counts")
+	}
+	equal := run(0.5, 0.5)
+	if !equal["light"] || !equal["heavy"] {
+		t.Error("Should have let heavy outlast light only for a while, got", equal)
+	}
+	weightOnly := run(1, 0)
+	if !weightOnly["light"] || weightOnly["heavy"] {
+		t.Error("Should never have evicted the heavy key when only weight counts, got", weightOnly)
+	}
+	unset := run(0, 0)
+	for k := range equal {
+		if !unset[k] {
+			t.Error("Should have weighed weight and age equally by default, kept", k)
+		}
+	}
+
+	if _, err := NewCache(WithEvictionFactors(-1, 1)); err != ErrInvalidOption {
+		t.Error("Should have rejected a negative factor, got", err)
+	}
+	if _, err := NewCache(WithEvictionFactors(0, 0)); err != ErrInvalidOption {
+		t.Error("Should have rejected two zero factors, got", err)
+	}
+	if _, err := NewCache(WithEvictionFactors(0.2, 0.8), WithEvictionFactors(0.5, 0.5)); err != ErrOptionConflict {
+		t.Error("Should have rejected conflicting factors, got", err)
+	}
+}
+
+func TestReloadOnPut(t *testing.T) {
+	c := NewPowerCache()
+	c.ReloadOnPut = true
+	var loads int32
+	release := make(chan struct{})
+	loaded := make(chan struct{}, 10)
+	c.ValueLoader = func(key string) (interface{}, error) {
+		<-release
+		atomic.AddInt32(&loads, 1)
+		defer func() { loaded <- struct{}{} }()
+		return "authoritative", nil
+	}
+	c.Put("a", "dirty")
+	if v, _ := c.GetIfPresent("a"); v != "dirty" {
+		t.Error("Should have stored the put value straight away, got", v)
+	}
+	release <- struct{}{}
+	<-loaded
+	//Give a second load the chance to happen if it was going to
+	time.Sleep(time.Millisecond * 10)
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Error("Should have loaded exactly once, got", n)
+	}
+	if v, _ := c.GetIfPresent("a"); v != "authoritative" {
+		t.Error("Should have stored the reloaded value, got", v)
+	}
+
+	//Puts while a reload is running make it go round once more
+	c.Put("b", "dirty")
+	c.Put("b", "dirty")
+	c.Put("b", "dirty")
+	close(release)
+	<-loaded
+	<-loaded
+	time.Sleep(time.Millisecond * 10)
+	if n := atomic.LoadInt32(&loads); n != 3 {
+		t.Error("Should have folded the puts into two loads, got", n)
+	}
+	c.mu.RLock()
+	if len(c.reloads) != 0 {
+		t.Error("Should have forgotten finished reloads, got", c.reloads)
+	}
+	c.mu.RUnlock()
+}
+
+func TestTouch(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterAccessDuration = time.Millisecond * 40
+	c.Put("a", "a")
+	c.Put("b", "b")
+	if c.Touch("missing") {
+		t.Error("Should not have touched a missing key")
+	}
+	for i := 0; i < 4; i++ {
+		time.Sleep(time.Millisecond * 15)
+		if !c.Touch("a") {
+			t.Error("Should have touched a")
+		}
+	}
+	//b was left alone and is about to go, a was kept alive
+	_, bTTL, _ := c.GetWithTTL("b")
+	if bTTL > 0 {
+		t.Error("Should have let b expire, got", bTTL)
+	}
+	_, aTTL, err := c.GetWithTTL("a")
+	if err != nil || aTTL < time.Millisecond*20 {
+		t.Error("Should have kept a alive with Touch, got", aTTL, err)
+	}
+	if c.RequestCount() != 2 {
+		t.Error("Should not have counted touches as requests, got", c.RequestCount())
+	}
+	time.Sleep(time.Millisecond * 50)
+	if c.Touch("a") {
+		t.Error("Should not have touched an expired key")
+	}
+	if c.Length() != 0 {
+		t.Error("Should have removed the expired key, got", c.Length())
+	}
+}
+
+func TestPutReplacingAdjustsWeightAndSize(t *testing.T) {
+	c := NewPowerCache()
+	length := func(key string, value interface{}) int64 {
+		return int64(len(value.(string)))
+	}
+	c.Weigher = length
+	c.Sizer = length
+	c.Initialize()
+	c.Put("a", "heavyvalue")
+	c.Put("b", "b")
+	if c.WeightedSize() != 11 || c.Size() != 11 {
+		t.Error("Should have added both values, got", c.WeightedSize(), c.Size())
+	}
+	c.Put("a", "lite")
+	if c.WeightedSize() != 5 || c.Size() != 5 {
+		t.Error("Should have swapped the heavy value's share for the light one's, got", c.WeightedSize(), c.Size())
+	}
+	c.ReplaceIfPresent("a", "heavyvalue!")
+	c.PutWithMeta("b", "", nil)
+	if c.WeightedSize() != 11 || c.Size() != 11 {
+		t.Error("Should have adjusted on every kind of replace, got", c.WeightedSize(), c.Size())
+	}
+	c.Invalidate("a")
+	if c.WeightedSize() != 0 || c.Size() != 0 {
+		t.Error("Should have nothing left to weigh, got", c.WeightedSize(), c.Size())
+	}
+}
+
+func TestGetMaxStale(t *testing.T) {
+	c := NewPowerCache()
+	loads := 0
+	c.ValueLoader = func(key string) (interface{}, error) {
+		loads++
+		return "loaded", nil
+	}
+	c.Put("a", "cached")
+	time.Sleep(time.Millisecond * 20)
+
+	if v, err := c.GetMaxStale("a", time.Minute); err != nil || v != "cached" {
+		t.Error("Should have returned the cached value within maxStale, got", v, err)
+	}
+	if loads != 0 {
+		t.Error("Should not have loaded a young enough value, got", loads)
+	}
+	if v, err := c.GetMaxStale("a", time.Millisecond*10); err != nil || v != "loaded" {
+		t.Error("Should have reloaded a value older than maxStale, got", v, err)
+	}
+	if loads != 1 {
+		t.Error("Should have loaded once, got", loads)
+	}
+	//The reload is fresh, so the tight bound is happy with it now
+	if v, _ := c.GetMaxStale("a", time.Millisecond*10); v != "loaded" || loads != 1 {
+		t.Error("Should have used the reloaded value, got", v, loads)
+	}
+	if v, _ := c.GetMaxStale("b", time.Minute); v != "loaded" || loads != 2 {
+		t.Error("Should have loaded a missing key, got", v, loads)
+	}
+	if c.HitCount() != 2 || c.MissCount() != 2 {
+		t.Error("Should have counted the stale read as a miss, got", c.HitCount(), c.MissCount())
+	}
+}
+
+func TestRecentHitRate(t *testing.T) {
+	c := NewPowerCache()
+	c.HitRateWindow = 100
+	c.Put("a", "a")
+	//Warm up with nothing but hits, then thrash
+	for i := 0; i < 1000; i++ {
+		c.GetIfPresent("a")
+	}
+	if c.RecentHitRate() != 1 {
+		t.Error("Should have had only hits in the window, got", c.RecentHitRate())
+	}
+	for i := 0; i < 75; i++ {
+		c.GetIfPresent(fmt.Sprint(i))
+	}
+	if c.RecentHitRate() != 0.25 {
+		t.Error("Should have let the misses push out the old hits, got", c.RecentHitRate())
+	}
+	if c.HitRate() < 0.9 {
+		t.Error("Should still have a high cumulative hit rate, got", c.HitRate())
+	}
+	for i := 0; i < 100; i++ {
+		c.GetIfPresent(fmt.Sprint(i))
+	}
+	if c.RecentHitRate() != 0 {
+		t.Error("Should have had only misses in the window, got", c.RecentHitRate())
+	}
+	c.ResetStats()
+	if c.RecentHitRate() != 0 {
+		t.Error("Should have cleared the window, got", c.RecentHitRate())
+	}
+	c.GetIfPresent("a")
+	if c.RecentHitRate() != 1 {
+		t.Error("Should have started the window over, got", c.RecentHitRate())
+	}
+}
+
+func TestGetWithResult(t *testing.T) {
+	c := NewPowerCache()
+	c.ValueLoader = func(key string) (interface{}, error) {
+		if key == "bad" {
+			return nil, errors.New("bad")
+		}
+		return key, nil
+	}
+	v, loaded, err := c.GetWithResult("a")
+	if err != nil || v != "a" || !loaded {
+		t.Error("Should have loaded a cold key, got", v, loaded, err)
+	}
+	v, loaded, err = c.GetWithResult("a")
+	if err != nil || v != "a" || loaded {
+		t.Error("Should have read a warm key from the cache, got", v, loaded, err)
+	}
+	if _, loaded, err := c.GetWithResult("bad"); err == nil || !loaded {
+		t.Error("Should have reported the failed load, got", loaded, err)
+	}
+	c.ValueLoader = nil
+	if _, loaded, err := c.GetWithResult("b"); err != ErrNoLoader || loaded {
+		t.Error("Should not have loaded without a loader, got", loaded, err)
+	}
+}
+
+func TestMaxEntryWeight(t *testing.T) {
+	c := NewPowerCache()
+	c.MaxWeight = 100
+	c.MaxEntryWeight = 50
+	c.Weigher = func(key string, value interface{}) int64 {
+		return int64(value.(int))
+	}
+	var removed []string
+	c.RemovalListener = func(key string, value interface{}, cause RemovalCause) {
+		removed = append(removed, key)
+	}
+	c.Initialize()
+	c.Put("a", 10)
+	c.Put("b", 20)
+	c.Put("huge", 60)
+	if _, err := c.GetIfPresent("huge"); err != ErrNotPresent {
+		t.Error("Should have turned away the oversized value, got", err)
+	}
+	if c.Length() != 2 || c.WeightedSize() != 30 || len(removed) != 0 {
+		t.Error("Should have left the smaller values alone, got", c.Length(), c.WeightedSize(), removed)
+	}
+
+	if err := c.PutChecked("huge", 60); err != ErrWeightTooLarge {
+		t.Error("Should have returned ErrWeightTooLarge, got", err)
+	}
+	if err := c.PutChecked("c", 50); err != nil {
+		t.Error("Should have stored a value at the limit, got", err)
+	}
+	//The old value mustn't outlive a rejected replacement
+	if err := c.PutChecked("a", 51); err != ErrWeightTooLarge {
+		t.Error("Should have rejected the heavier replacement, got", err)
+	}
+	if _, err := c.GetIfPresent("a"); err != ErrNotPresent {
+		t.Error("Should have dropped the old value of a, got", err)
+	}
+	if err := c.SetWeight("b", 51); err != ErrWeightTooLarge {
+		t.Error("Should have refused to weigh b over the limit, got", err)
+	}
+	checkConsistent(t, c)
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Millisecond * 10
+	c.StaleWhileRevalidate = true
+	var loads int32
+	loading := make(chan struct{})
+	release := make(chan struct{})
+	c.ValueLoader = func(key string) (interface{}, error) {
+		if atomic.AddInt32(&loads, 1) == 1 {
+			close(loading)
+			<-release
+			return "new", nil
+		}
+		return nil, errors.New("down")
+	}
+	c.Put("a", "old")
+	time.Sleep(time.Millisecond * 20)
+
+	reloaded := make(chan interface{})
+	go func() {
+		v, _ := c.Get("a")
+		reloaded <- v
+	}()
+	<-loading
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := c.Get("a"); err != nil || v != "old" {
+				t.Error("Should have served the stale value during the reload, got", v, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(release)
+	if v := <-reloaded; v != "new" {
+		t.Error("Should have handed the reloaded value to the reloading caller, got", v)
+	}
+	if v, _ := c.Get("a"); v != "new" {
+		t.Error("Should have cached the reloaded value, got", v)
+	}
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Error("Should have run the loader once, got", n)
+	}
+
+	//A failed reload drops the stale value
+	time.Sleep(time.Millisecond * 20)
+	if _, err := c.Get("a"); err == nil {
+		t.Error("Should have returned the failed reload's error")
+	}
+	if _, err := c.GetIfPresent("a"); err != ErrNotPresent {
+		t.Error("Should not have kept serving the stale value, got", err)
+	}
+	if len(c.revalidating) != 0 {
+		t.Error("Should have forgotten finished reloads, got", c.revalidating)
+	}
+}
+
+func TestKeyNormalizer(t *testing.T) {
+	c := NewPowerCache()
+	c.KeyNormalizer = strings.ToLower
+	c.TrackKeyStats = true
+	var loaded []string
+	c.ValueLoader = func(key string) (interface{}, error) {
+		loaded = append(loaded, key)
+		return key, nil
+	}
+	c.Put("Foo", "foo")
+	if v, err := c.GetIfPresent("FOO"); err != nil || v != "foo" {
+		t.Error("Should have found Foo as FOO, got", v, err)
+	}
+	if v, _ := c.Get("fOO"); v != "foo" || len(loaded) != 0 {
+		t.Error("Should have hit without loading, got", v, loaded)
+	}
+	if v, _ := c.Get("Bar"); v != "bar" || loaded[0] != "bar" {
+		t.Error("Should have loaded the normalized key, got", v, loaded)
+	}
+	if c.Length() != 2 {
+		t.Error("Should have stored one entry per normalized key, got", c.Length())
+	}
+	found := c.GetAllWithTTL([]string{"FOO", "BAR"})
+	if found["FOO"].Value != "foo" || found["BAR"].Value != "bar" {
+		t.Error("Should have keyed the results the way they were asked for, got", found)
+	}
+	top := c.TopKeys(1)
+	if len(top) != 1 || top[0].Key != "foo" || top[0].Hits != 3 {
+		t.Error("Should have counted stats under the normalized key, got", top)
+	}
+	c.Invalidate("BAR")
+	if _, err := c.GetIfPresent("bar"); err != ErrNotPresent {
+		t.Error("Should have invalidated bar as BAR, got", err)
+	}
+	checkConsistent(t, c)
+
+	//Typed caches keep their values under the normalized key too
+	p := NewPowerCache()
+	p.KeyNormalizer = strings.ToLower
+	sc := NewStringCache(p)
+	sc.Put("A", "x")
+	if v, err := sc.GetIfPresent("a"); err != nil || v != "x" {
+		t.Error("Should have found A as a in a typed cache, got", v, err)
+	}
+	sc.Invalidate("A")
+	if p.Length() != 0 || len(sc.values) != 0 {
+		t.Error("Should have dropped the typed value as well, got", p.Length(), len(sc.values))
+	}
+}
+
+func TestClear(t *testing.T) {
+	c := NewPowerCache()
+	removed := 0
+	c.RemovalListener = func(key string, value interface{}, cause RemovalCause) {
+		removed++
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		c.Put(k, k)
+	}
+	c.GetIfPresent("a")
+	c.Clear()
+	if c.Length() != 0 || removed != 3 {
+		t.Error("Should have emptied the cache and told the listener, got", c.Length(), removed)
+	}
+	if c.EvictionCount() != 0 || c.Stats().ExplicitEvictions != 0 {
+		t.Error("Should not have counted the flush as evictions, got", c.EvictionCount())
+	}
+	if c.HitCount() != 1 {
+		t.Error("Should have kept the other stats, got", c.HitCount())
+	}
+
+	c.Put("a", "a")
+	c.InvalidateAll()
+	if c.EvictionCount() != 1 {
+		t.Error("Should still have counted InvalidateAll, got", c.EvictionCount())
+	}
+	checkConsistent(t, c)
+}
+
+func TestSetExpiresAfterWrite(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Hour
+	c.MaxKeys = 10
+	c.Put("a", "a")
+	c.SetExpiresAfterWrite(time.Millisecond * 20)
+	c.Put("b", "b")
+	if _, ttl, _ := c.GetWithTTL("b"); ttl > time.Millisecond*20 {
+		t.Error("Should have used the new duration for a new put, got", ttl)
+	}
+	if _, ttl, _ := c.GetWithTTL("a"); ttl > time.Millisecond*20 {
+		t.Error("Should have held the old entry to the new duration, got", ttl)
+	}
+	time.Sleep(time.Millisecond * 30)
+	if c.InvalidateExpired() != 2 {
+		t.Error("Should have expired both entries under the new duration")
+	}
+
+	c.SetExpiresAfterWrite(0)
+	c.SetExpiresAfterAccess(time.Millisecond * 20)
+	c.Put("c", "c")
+	time.Sleep(time.Millisecond * 30)
+	if _, err := c.GetIfPresent("c"); err != ErrNotPresent {
+		t.Error("Should have expired c after access, got", err)
+	}
+	c.SetExpiresAfterAccess(0)
+	if err := c.PutWithTTL("d", "d", time.Minute); err != ErrNoExpiry {
+		t.Error("Should have no expiry policy left, got", err)
+	}
+	checkConsistent(t, c)
+}
+
+func TestGetBatch(t *testing.T) {
+	c := NewPowerCache()
+	var inFlight, most, loads int32
+	c.ValueLoader = func(key string) (interface{}, error) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		atomic.AddInt32(&loads, 1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond * 5)
+		if key == "bad" {
+			return nil, errors.New("bad")
+		}
+		return key, nil
+	}
+	c.Put("cached", "cached")
+	keys := []string{"cached", "bad", "cached"}
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprint(i), fmt.Sprint(i))
+	}
+	values, errs := c.GetBatch(keys, 4)
+	if len(values) != 21 || len(errs) != 1 || errs["bad"] == nil {
+		t.Error("Should have resolved every key, got", len(values), errs)
+	}
+	for i := 0; i < 20; i++ {
+		if values[fmt.Sprint(i)] != fmt.Sprint(i) {
+			t.Error("Should have loaded", i, "got", values[fmt.Sprint(i)])
+		}
+	}
+	if values["cached"] != "cached" {
+		t.Error("Should have read the cached key, got", values["cached"])
+	}
+	if n := atomic.LoadInt32(&loads); n != 21 {
+		t.Error("Should have loaded each missing key once, got", n)
+	}
+	if m := atomic.LoadInt32(&most); m > 4 || m < 2 {
+		t.Error("Should have loaded concurrently within the cap, got", m)
+	}
+}
+
+func TestEncoderDecoder(t *testing.T) {
+	c := NewPowerCache()
+	c.Encoder = func(value interface{}) interface{} {
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		w.Write(value.([]byte))
+		w.Close()
+		return b.Bytes()
+	}
+	c.Decoder = func(encoded interface{}) interface{} {
+		r, err := gzip.NewReader(bytes.NewReader(encoded.([]byte)))
+		if err != nil {
+			return nil
+		}
+		b, _ := ioutil.ReadAll(r)
+		return b
+	}
+	c.Weigher = func(key string, value interface{}) int64 {
+		return int64(len(value.([]byte)))
+	}
+
+	//A long run of the same byte compresses to almost nothing
+	raw := bytes.Repeat([]byte("a"), 10000)
+	c.Put("key", raw)
+	if v, err := c.GetIfPresent("key"); err != nil || !bytes.Equal(v.([]byte), raw) {
+		t.Error("Should have decoded the original value on the way out")
+	}
+	if w := c.WeightedSize(); w <= 0 || w >= int64(len(raw)) {
+		t.Error("Should have weighed the compressed value, got", w)
+	}
+	var removed interface{}
+	c.RemovalListener = func(key string, value interface{}, cause RemovalCause) {
+		removed = value
+	}
+	var out bytes.Buffer
+	if err := c.ExportJSON(&out, true); err != nil {
+		t.Fatal(err)
+	}
+	var exported []struct{ Value []byte }
+	if err := json.Unmarshal(out.Bytes(), &exported); err != nil || len(exported) != 1 || !bytes.Equal(exported[0].Value, raw) {
+		t.Error("Should have exported the decoded value")
+	}
+	c.Invalidate("key")
+	if b, ok := removed.([]byte); !ok || !bytes.Equal(b, raw) {
+		t.Error("Should have handed the listener the decoded value")
+	}
+}
+
+func TestReentrantRemovalListener(t *testing.T) {
+	c := NewPowerCache()
+	c.MaxKeys = 10
+	c.RemovalListener = func(key string, value interface{}, cause RemovalCause) {
+		//Each removal takes its partner with it and reads the cache back
+		if strings.HasPrefix(key, "a") {
+			c.Invalidate("b" + key[1:])
+		}
+		c.GetIfPresent(key)
+		c.Length()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					k := fmt.Sprint(g, "-", i)
+					c.Put("a"+k, i)
+					c.Put("b"+k, i)
+					c.Invalidate("a" + k)
+				}
+			}(g)
+		}
+		wg.Wait()
+		c.InvalidateAll()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 10):
+		t.Fatal("Should not have deadlocked calling the cache from the listener")
+	}
+	if n := c.Length(); n != 0 {
+		t.Error("Should have emptied the cache, got", n)
+	}
+}
+
+func TestTakeEvictionCount(t *testing.T) {
+	c := NewPowerCache()
+	c.MaxKeys = 5
+	for i := 0; i < 8; i++ {
+		c.Put(fmt.Sprint(i), i)
+	}
+	first := c.TakeEvictionCount()
+	if first == 0 {
+		t.Error("Should have reported the evictions so far")
+	}
+	if n := c.TakeEvictionCount(); n != 0 {
+		t.Error("Should have reset the count, got", n)
+	}
+	c.Invalidate("7")
+	c.Invalidate("6")
+	if n := c.TakeEvictionCount(); n != 2 {
+		t.Error("Should have reported only the evictions since the last call, got", n)
+	}
+	if s := c.Stats(); s.Evictions != 0 || s.ExplicitEvictions != 0 || s.SizeEvictions != 0 {
+		t.Error("Should have reset the counts by cause too, got", s)
+	}
+}
+
+func TestSoftMaxKeys(t *testing.T) {
+	c := NewPowerCache()
+	c.MaxKeys = 100
+	c.SoftMaxKeys = 50
+
+	//Pretend a trim is already running so only the hot path can evict
+	c.trimming = true
+	for i := 0; i < 80; i++ {
+		c.Put(fmt.Sprint(i), i)
+	}
+	if n := c.Length(); n != 80 {
+		t.Error("Should not have evicted inline below the hard limit, got", n)
+	}
+	for i := 80; i < 150; i++ {
+		c.Put(fmt.Sprint(i), i)
+		if n := c.Length(); n > 100 {
+			t.Fatal("Should have evicted inline at the hard limit, got", n)
+		}
+	}
+
+	c.mu.Lock()
+	c.trimming = false
+	c.mu.Unlock()
+	c.Put("last", 0)
+	waitFor(t, c, func() bool { return !c.trimming })
+	if n := c.Length(); n > 50 || n == 0 {
+		t.Error("Should have trimmed down to the soft limit in the background, got", n)
+	}
+	if _, err := c.GetIfPresent("last"); err != nil {
+		t.Error("Should have kept the most recent key")
+	}
+}
+
+func TestBatchLoadsDuplicateKeysOnce(t *testing.T) {
+	var loads int32
+	c := NewPowerCache()
+	c.ValueLoader = func(key string) (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		if key == "b" {
+			return nil, errors.New("bad")
+		}
+		return key, nil
+	}
+	keys := []string{"a", "a", "b"}
+
+	if errs := c.RefreshAll(keys, 2); len(errs) != 1 || errs["b"] == nil {
+		t.Error("Should have one error for the distinct failing key, got", errs)
+	}
+	if n := atomic.SwapInt32(&loads, 0); n != 2 {
+		t.Error("Should have refreshed each distinct key once, got", n)
+	}
+
+	c.InvalidateAll()
+	c.WarmUp(keys)
+	if n := atomic.SwapInt32(&loads, 0); n != 2 {
+		t.Error("Should have warmed up each distinct key once, got", n)
+	}
+
+	c.InvalidateAll()
+	values, errs := c.GetBatch(keys, 2)
+	if len(values) != 1 || values["a"] != "a" || len(errs) != 1 {
+		t.Error("Should have one result per distinct key, got", values, errs)
+	}
+	if n := atomic.SwapInt32(&loads, 0); n != 2 {
+		t.Error("Should have loaded each distinct key once, got", n)
+	}
+}
+
+func TestBackgroundCleanUp(t *testing.T) {
+	c := NewPowerCache()
+	c.MaxKeys = 10
+	c.BackgroundCleanUp = true
+
+	//Pretend a clean up is already running so a Put can't start one
+	c.cleaning = true
+	for i := 0; i < 20; i++ {
+		c.Put(fmt.Sprint(i), i)
+	}
+	if n := c.Length(); n != 20 {
+		t.Error("Should not have evicted inline, got", n)
+	}
+
+	c.mu.Lock()
+	c.cleaning = false
+	c.mu.Unlock()
+	c.Put("last", 0)
+	waitFor(t, c, func() bool { return !c.cleaning })
+	if n := c.Length(); n >= 10 {
+		t.Error("Should have evicted back under MaxKeys in the background, got", n)
+	}
+}
+
+func TestCachedAt(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterAccessDuration = time.Hour
+	before := time.Now()
+	c.Put("key", 1)
+	after := time.Now()
+	at, ok := c.CachedAt("key")
+	if !ok || at.Before(before) || at.After(after) {
+		t.Error("Should have returned the time of the Put, got", at, ok)
+	}
+
+	time.Sleep(time.Millisecond * 2)
+	c.GetIfPresent("key")
+	c.SetExpiresIn("key", time.Minute)
+	if again, _ := c.CachedAt("key"); !again.Equal(at) {
+		t.Error("Should not have moved on a read or a new deadline, got", again)
+	}
+	if d, _ := c.ExpiresAt("key"); d.Equal(at) {
+		t.Error("Should have kept the write time apart from the deadline")
+	}
+
+	c.Put("key", 2)
+	if again, _ := c.CachedAt("key"); !again.After(at) {
+		t.Error("Should have moved on a new value, got", again)
+	}
+	if _, ok := c.CachedAt("missing"); ok {
+		t.Error("Should not have found a missing key")
+	}
+}
+
+func TestServeStaleOnError(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Millisecond * 5
+	c.ServeStaleOnError = true
+	var down int32 = 1
+	var loads int32
+	c.ValueLoader = func(key string) (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		if key == "gone" {
+			return nil, ErrNotFound
+		}
+		if atomic.LoadInt32(&down) == 1 {
+			return nil, errors.New("backend down")
+		}
+		return "fresh", nil
+	}
+	c.Put("key", "stale")
+	c.Put("gone", "stale")
+	time.Sleep(time.Millisecond * 10)
+
+	for i := 0; i < 2; i++ {
+		if v, err := c.Get("key"); err != nil || v != "stale" {
+			t.Error("Should have served the stale value while the loader fails, got", v, err)
+		}
+	}
+	if n := atomic.LoadInt32(&loads); n != 2 {
+		t.Error("Should have tried the loader on every Get, got", n)
+	}
+	if _, err := c.GetIfPresent("key"); err != ErrNotPresent {
+		t.Error("Should still have treated the entry as expired, got", err)
+	}
+	if _, err := c.Get("gone"); !errors.Is(err, ErrNotFound) {
+		t.Error("Should not have served a stale value for a key that's gone, got", err)
+	}
+
+	c.Put("key", "stale")
+	time.Sleep(time.Millisecond * 10)
+	atomic.StoreInt32(&down, 0)
+	if v, err := c.Get("key"); err != nil || v != "fresh" {
+		t.Error("Should have served the reloaded value once the loader works, got", v, err)
+	}
+}
+
+func TestPutIfVersion(t *testing.T) {
+	c := NewPowerCache()
+	if !c.PutIfVersion("key", 1, 0) {
+		t.Error("Should have added a missing key at version 0")
+	}
+	if c.PutIfVersion("key", 2, 0) {
+		t.Error("Should not have added a key that's already there")
+	}
+
+	//Two writers read the same version, only the first write wins
+	_, va, _ := c.GetVersioned("key")
+	_, vb, _ := c.GetVersioned("key")
+	if va != vb || va == 0 {
+		t.Error("Should have read the same version twice, got", va, vb)
+	}
+	if !c.PutIfVersion("key", "a", va) {
+		t.Error("Should have stored the first write")
+	}
+	if c.PutIfVersion("key", "b", vb) {
+		t.Error("Should have rejected the stale write")
+	}
+	v, vc, err := c.GetVersioned("key")
+	if err != nil || v != "a" || vc <= va {
+		t.Error("Should have kept the first write at a newer version, got", v, vc, err)
+	}
+
+	//A plain Put moves the version on too, even back to the same value
+	c.Put("key", "a")
+	if c.PutIfVersion("key", "c", vc) {
+		t.Error("Should have rejected a write made before the Put")
+	}
+
+	//Removing and putting again never brings an old version back
+	_, vd, _ := c.GetVersioned("key")
+	c.Invalidate("key")
+	c.Put("key", "a")
+	if _, ve, _ := c.GetVersioned("key"); ve <= vd {
+		t.Error("Should have given the new value a newer version, got", ve, vd)
+	}
+	if _, _, err := c.GetVersioned("missing"); err != ErrNotPresent {
+		t.Error("Should not have found a missing key, got", err)
+	}
+}
+
+func TestSetExpiresInValidates(t *testing.T) {
+	c := NewPowerCache()
+	c.Put("key", 1)
+	if err := c.SetExpiresIn("key", time.Minute); err != ErrNoExpiry {
+		t.Error("Should have refused a deadline nothing would check, got", err)
+	}
+	if _, ok := c.deadline["key"]; ok {
+		t.Error("Should not have kept the deadline")
+	}
+
+	c.ExpiresAfterWriteDuration = time.Hour
+	if err := c.SetExpiresIn("key", -time.Minute); err != ErrExpiresInPast {
+		t.Error("Should have refused a deadline in the past, got", err)
+	}
+	if err := c.SetExpiresIn("key", time.Minute); err != nil {
+		t.Error("Should have set the deadline, got", err)
+	}
+	if d, _ := c.ExpiresAt("key"); time.Until(d) > time.Minute {
+		t.Error("Should expire within the minute, got", d)
+	}
+}
+
+func TestPerKeyExpiry(t *testing.T) {
+	c := NewPowerCache()
+	c.PerKeyExpiry = true
+	c.Put("permanent", 1)
+	c.Put("short", 2)
+	if err := c.SetExpiresIn("short", time.Millisecond*5); err != nil {
+		t.Error("Should have taken a deadline without a global TTL, got", err)
+	}
+	if err := c.PutWithTTL("ttl", 3, time.Millisecond*5); err != nil {
+		t.Error("Should have put with a TTL without a global TTL, got", err)
+	}
+	if ttl := c.ttlOf("permanent", time.Now()); ttl != NoExpiration {
+		t.Error("Should not have given a key without a deadline a TTL, got", ttl)
+	}
+
+	time.Sleep(time.Millisecond * 10)
+	c.CleanUp()
+	if n := c.Length(); n != 1 {
+		t.Error("Should have swept out only the keys with deadlines, got", n)
+	}
+	if _, err := c.GetIfPresent("permanent"); err != nil {
+		t.Error("Should have kept the key without a deadline")
+	}
+	if _, err := c.GetIfPresent("short"); err != ErrNotPresent {
+		t.Error("Should have expired the key with a deadline, got", err)
+	}
+}
+
+func TestInvalidateAllExcept(t *testing.T) {
+	c := NewPowerCache()
+	var removed []string
+	c.RemovalListener = func(key string, value interface{}, cause RemovalCause) {
+		removed = append(removed, key)
+	}
+	for _, k := range []string{"keep:a", "keep:b", "x", "y", "z"} {
+		c.Put(k, k)
+	}
+	n := c.InvalidateAllExcept(func(key string) bool {
+		return strings.HasPrefix(key, "keep:")
+	})
+	if n != 3 || c.Length() != 2 {
+		t.Error("Should have removed only the keys not kept, got", n, c.Length())
+	}
+	for _, k := range []string{"keep:a", "keep:b"} {
+		if _, err := c.GetIfPresent(k); err != nil {
+			t.Error("Should have kept", k)
+		}
+	}
+	if len(removed) != 3 {
+		t.Error("Should have told the listener about each removed key, got", removed)
+	}
+	for _, k := range removed {
+		if strings.HasPrefix(k, "keep:") {
+			t.Error("Should not have reported a kept key, got", k)
+		}
+	}
+	if s := c.Stats(); s.Evictions != 3 || s.ExplicitEvictions != 3 {
+		t.Error("Should have counted only the removed keys, got", s)
+	}
+}
+
+func TestLoaderErrors(t *testing.T) {
+	c := NewPowerCache()
+	backendDown := errors.New("backend down")
+	c.ValueLoader = func(key string) (interface{}, error) {
+		if key == "missing" {
+			return nil, ErrNotFound
+		}
+		return nil, backendDown
+	}
+
+	_, err := c.Get("a")
+	if !errors.Is(err, ErrLoaderFailed) || !errors.Is(err, backendDown) {
+		t.Error("Should have wrapped the loader's error, got", err)
+	}
+	var le *LoaderError
+	if !errors.As(err, &le) || le.Key != "a" || le.Err != backendDown {
+		t.Error("Should have told which key failed and why, got", le)
+	}
+	if errors.Is(err, ErrNotPresent) {
+		t.Error("Should not have looked like a plain miss")
+	}
+
+	//The loader saying a key doesn't exist is still a loader result
+	_, err = c.Get("missing")
+	if !errors.Is(err, ErrNotFound) || !errors.Is(err, ErrLoaderFailed) {
+		t.Error("Should have wrapped the loader's ErrNotFound, got", err)
+	}
+	_, err = c.GetIfPresent("missing")
+	if !errors.Is(err, ErrNotPresent) || errors.Is(err, ErrLoaderFailed) {
+		t.Error("Should have returned a plain miss, got", err)
+	}
+
+	//Remembered failures come back the way the load returned them
+	c.NegativeTTL = time.Minute
+	c.ErrorTTL = time.Minute
+	for _, key := range []string{"missing", "b"} {
+		_, fresh := c.Get(key)
+		_, remembered := c.Get(key)
+		if !errors.Is(remembered, ErrLoaderFailed) || remembered.Error() != fresh.Error() {
+			t.Error("Should have remembered the wrapped error for", key, "got", remembered)
+		}
+	}
+	if _, err := c.GetIfPresent("missing"); !errors.Is(err, ErrNotFound) || !errors.Is(err, ErrLoaderFailed) {
+		t.Error("Should have wrapped the remembered ErrNotFound, got", err)
+	}
+}
+
+func TestLoadDurationPercentile(t *testing.T) {
+	c := NewPowerCache()
+	c.TrackLoadDurations = true
+	if d := c.LoadDurationPercentile(0.5); d != 0 {
+		t.Error("Should be 0 before anything was loaded, got", d)
+	}
+	for i := 0; i < 98; i++ {
+		c.recordLoadDuration(&c.statLoadHist, time.Millisecond)
+	}
+	for i := 0; i < 2; i++ {
+		c.recordLoadDuration(&c.statLoadHist, time.Millisecond*100)
+	}
+	//Each is the top of the doubling bucket it falls in
+	if d := c.LoadDurationPercentile(0.5); d < time.Millisecond || d > time.Millisecond*2 {
+		t.Error("Should have put p50 in the 1ms bucket, got", d)
+	}
+	if d := c.LoadDurationPercentile(0.99); d < time.Millisecond*100 || d > time.Millisecond*200 {
+		t.Error("Should have put p99 in the 100ms bucket, got", d)
+	}
+
+	if c.LoadDurationPercentile(2) != c.LoadDurationPercentile(1) || c.LoadDurationPercentile(-1) != c.LoadDurationPercentile(0) {
+		t.Error("Should have clamped p to between 0 and 1")
+	}
+
+	//Failures only count when they're penalized
+	for i := 0; i < 200; i++ {
+		c.recordLoadDuration(&c.statLoadFailHist, time.Second)
+	}
+	if d := c.LoadDurationPercentile(0.5); d > time.Millisecond*2 {
+		t.Error("Should have left out the failed loads, got", d)
+	}
+	c.PenalizeLoadFailures = true
+	if d := c.LoadDurationPercentile(0.5); d < time.Second || d > time.Second*2 {
+		t.Error("Should have counted the failed loads, got", d)
+	}
+
+	//Real loads land in the histogram too
+	c.ResetStats()
+	c.ValueLoader = func(key string) (interface{}, error) {
+		time.Sleep(time.Millisecond * 5)
+		return key, nil
+	}
+	c.Get("a")
+	if d := c.LoadDurationPercentile(0.5); d < time.Millisecond*5 {
+		t.Error("Should have recorded the load, got", d)
+	}
+}
+
+func TestSoftCache(t *testing.T) {
+	p := NewPowerCache()
+	for i := 0; i < 100; i++ {
+		p.Put(fmt.Sprint(i), i)
+	}
+	//Pretend every entry takes up a kilobyte of heap
+	s := &SoftCache{PowerCache: p, maxHeap: 50 * 1024}
+	s.heapAlloc = func() uint64 {
+		return uint64(p.Length()) * 1024
+	}
+	ticks := make(chan time.Time)
+	s.start(ticks, func() {})
+
+	//Each poll over the limit sheds a quarter, until it's under
+	for i := 0; i < 10; i++ {
+		ticks <- time.Now()
+	}
+	s.Close()
+	if n := p.Length(); n > 50 || n < 35 {
+		t.Error("Should have shed entries down to just under the limit, got", n)
+	}
+	if _, err := p.GetIfPresent("99"); err != nil {
+		t.Error("Should have shed the least recently used entries first")
+	}
+	if n := p.Stats().SizeEvictions; n != int64(100-p.Length()) {
+		t.Error("Should have counted the shed entries as size evictions, got", n)
+	}
+	s.Close()
+
+	if _, err := NewSoftCache(p, 1, 0); err != ErrInvalidOption {
+		t.Error("Should have refused an interval that isn't positive, got", err)
+	}
+	polled, err := NewSoftCache(p, 1<<62, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	polled.Close()
+}
+
+func TestSetWeights(t *testing.T) {
+	c := NewPowerCache()
+	c.MaxWeight = 100
+	for _, k := range []string{"a", "b", "c"} {
+		c.Put(k, k)
+	}
+	if err := c.SetWeights(map[string]int64{"a": 5, "b": 10, "missing": 20}); err != nil {
+		t.Error("Should have set the weights, got", err)
+	}
+	if w := c.WeightedSize(); w != 16 {
+		t.Error("Should have summed the new weights with the untouched one, got", w)
+	}
+	if _, ok := c.WeightOf("missing"); ok {
+		t.Error("Should have skipped the missing key")
+	}
+	if err := c.SetWeights(map[string]int64{"a": 1, "c": 200}); err != ErrWeightTooLarge {
+		t.Error("Should have refused a weight over MaxWeight, got", err)
+	}
+	if w, _ := c.WeightOf("a"); w != 5 || c.WeightedSize() != 16 {
+		t.Error("Should not have changed any weight in a refused batch, got", w, c.WeightedSize())
+	}
+	checkConsistent(t, c)
+}
+
+func TestGetWithFreshness(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Millisecond * 5
+	c.StaleWhileRevalidate = true
+	c.ServeStaleOnError = true
+	var down int32
+	release := make(chan struct{})
+	c.ValueLoader = func(key string) (interface{}, error) {
+		if key == "slow" {
+			<-release
+		}
+		if atomic.LoadInt32(&down) == 1 {
+			return nil, errors.New("backend down")
+		}
+		return "fresh", nil
+	}
+
+	c.Put("key", "old")
+	if v, fresh, err := c.GetWithFreshness("key"); err != nil || v != "old" || !fresh {
+		t.Error("Should have been fresh within the TTL, got", v, fresh, err)
+	}
+
+	//While one caller revalidates, the rest get the stale value
+	c.Put("slow", "old")
+	time.Sleep(time.Millisecond * 10)
+	done := make(chan bool)
+	go func() {
+		_, fresh, _ := c.GetWithFreshness("slow")
+		done <- fresh
+	}()
+	for i := 0; i < 100; i++ {
+		c.mu.RLock()
+		running := c.revalidating["slow"]
+		c.mu.RUnlock()
+		if running {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if v, fresh, err := c.GetWithFreshness("slow"); err != nil || v != "old" || fresh {
+		t.Error("Should have been stale while revalidating, got", v, fresh, err)
+	}
+	close(release)
+	if !<-done {
+		t.Error("Should have been fresh for the caller that reloaded")
+	}
+
+	//A failed reload serves the old value, marked stale
+	time.Sleep(time.Millisecond * 10)
+	atomic.StoreInt32(&down, 1)
+	if v, fresh, err := c.GetWithFreshness("key"); err != nil || v != "old" || fresh {
+		t.Error("Should have been stale after the reload failed, got", v, fresh, err)
+	}
+	c.StaleWhileRevalidate = false
+	if v, fresh, err := c.GetWithFreshness("key"); err != nil || v != "old" || fresh {
+		t.Error("Should have been stale with only ServeStaleOnError, got", v, fresh, err)
+	}
+	atomic.StoreInt32(&down, 0)
+	if v, fresh, err := c.GetWithFreshness("key"); err != nil || v != "fresh" || !fresh {
+		t.Error("Should have been fresh once the reload worked, got", v, fresh, err)
+	}
+}
+
+func TestTypedCacheSnapshotAndExport(t *testing.T) {
+	p := NewPowerCache()
+	s := NewStringCache(p)
+	s.Put("key", "value")
+
+	var out bytes.Buffer
+	if err := p.ExportJSON(&out, true); err != nil || !strings.Contains(out.String(), `"value":"value"`) {
+		t.Error("Should have exported the typed value, got", out.String(), err)
+	}
+	seen := 0
+	p.Range(func(key string, value interface{}) bool {
+		if value != "value" {
+			t.Error("Should have ranged over the typed value, got", value)
+		}
+		seen++
+		return true
+	})
+	if seen != 1 {
+		t.Error("Should have ranged over the one key, got", seen)
+	}
+
+	state := p.Snapshot()
+	if state.entries[0].Value != "value" {
+		t.Error("Should have snapshotted the typed value, got", state.entries[0].Value)
+	}
+	//Values of another type can't go in a StringCache
+	state.entries = append(state.entries, persistedEntry{Key: "other", Value: 1, Wtime: time.Now(), Atime: time.Now()})
+
+	q := NewPowerCache()
+	r := NewStringCache(q)
+	q.Restore(state)
+	if v, err := r.GetIfPresent("key"); err != nil || v != "value" {
+		t.Error("Should have restored into the typed cache, got", v, err)
+	}
+	if n := q.Length(); n != 1 {
+		t.Error("Should have skipped the value of the wrong type, got", n)
+	}
+}
+
+func TestStaleWhileRevalidateKeepsEntryForOtherReads(t *testing.T) {
+	c := NewPowerCache()
+	c.ExpiresAfterWriteDuration = time.Millisecond * 5
+	c.PeriodicMaintenance = time.Hour
+	c.StaleWhileRevalidate = true
+	var loads int32
+	release := make(chan struct{})
+	c.ValueLoader = func(key string) (interface{}, error) {
+		//Only the first reload waits, so an extra one fails the test rather than hanging it
+		if atomic.AddInt32(&loads, 1) == 1 {
+			<-release
+		}
+		return "new", nil
+	}
+	c.Put("key", "old")
+	time.Sleep(time.Millisecond * 10)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Get("key")
+	}()
+	for i := 0; i < 100 && atomic.LoadInt32(&loads) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	//None of these may drop the entry being revalidated
+	if _, err := c.GetIfPresent("key"); err != ErrNotPresent {
+		t.Error("Should have treated the expired entry as missing, got", err)
+	}
+	if c.Touch("key") || c.ReplaceIfPresent("key", "other") {
+		t.Error("Should not have found the expired entry")
+	}
+	if found := c.GetAllWithTTL([]string{"key"}); len(found) != 0 {
+		t.Error("Should not have returned the expired entry, got", found)
+	}
+	c.ForceCleanUp()
+	if v, err := c.Get("key"); err != nil || v != "old" {
+		t.Error("Should still have served the stale value, got", v, err)
+	}
+	close(release)
+	<-done
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Error("Should have only run the one reload, got", n)
+	}
+	if v, _ := c.GetIfPresent("key"); v != "new" {
+		t.Error("Should have stored the reloaded value, got", v)
+	}
+}
+
+// waitFor waits for a background goroutine to finish, checking done under the
+// cache lock
+func waitFor(t *testing.T, c *PowerCache, done func() bool) {
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		c.mu.RLock()
+		finished := done()
+		c.mu.RUnlock()
+		if finished {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("Should have finished in the background")
+}